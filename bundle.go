@@ -0,0 +1,314 @@
+package sprbox
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bundleExt is the extension of the config bundles,
+// LoadToolBox load the config files from the bundle
+// if the configPath has this extension.
+const bundleExt = ".tar.gz"
+
+// bundleSigExt is the extension of the bundle signature file,
+// side by side with the bundle (eg.: config.tar.gz.sig).
+const bundleSigExt = ".sig"
+
+// bundlePublicKey is the public key used to verify the bundles.
+var bundlePublicKey ed25519.PublicKey
+
+// Errors.
+var (
+	errNoBundlePublicKey = errors.New("bundle: no public key set, see SetBundlePublicKey()")
+	errBundleSignature   = errors.New("bundle: invalid signature")
+)
+
+// ParseBundlePublicKey decode a base64 encoded ed25519 public key,
+// as generated by `sprbox keygen`.
+func ParseBundlePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("bundle: invalid public key")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// isBundle returns true if path is a config bundle.
+func isBundle(path string) bool {
+	return strings.HasSuffix(path, bundleExt)
+}
+
+// CreateBundle package the config files in dir into a tar.gz bundle
+// at bundlePath, signed with the ed25519 privateKey.
+// The signature is written side by side with the bundle (<bundlePath>.sig).
+func CreateBundle(dir string, bundlePath string, privateKey ed25519.PrivateKey) error {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return errors.New("bundle: invalid private key")
+	}
+
+	var buf bytes.Buffer
+	if err := writeBundle(&buf, dir); err != nil {
+		return err
+	}
+
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, buf.Bytes()))
+
+	if err := ioutil.WriteFile(bundlePath, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(bundlePath+bundleSigExt, []byte(signature+"\n"), 0644)
+}
+
+// writeBundle write the regular files in dir to w as a tar.gz archive,
+// in lexicographic order and without timestamps, so that the same
+// files always produce the same bundle.
+func writeBundle(w io.Writer, dir string) error {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(files)
+
+	gzw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gzw)
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+
+		header := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     filepath.ToSlash(name),
+			Mode:     0644,
+			Size:     int64(len(data)),
+			ModTime:  time.Unix(0, 0),
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err = tw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+// OpenBundle verify the bundle at bundlePath against its signature
+// (<bundlePath>.sig) using the public key set with SetBundlePublicKey(),
+// then returns its files as a read-only, in-memory, fs.FS.
+//
+// Bundles are refused if no public key is set or the signature does not match.
+func OpenBundle(bundlePath string) (fs.FS, error) {
+	if len(bundlePublicKey) == 0 {
+		return nil, errNoBundlePublicKey
+	}
+
+	data, err := ioutil.ReadFile(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+
+	sig, err := ioutil.ReadFile(bundlePath + bundleSigExt)
+	if err != nil {
+		return nil, fmt.Errorf("bundle: missing signature: %v", err)
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil || !ed25519.Verify(bundlePublicKey, data, signature) {
+		return nil, errBundleSignature
+	}
+
+	return readBundle(data)
+}
+
+// readBundle returns the files in the tar.gz data.
+func readBundle(data []byte) (fs.FS, error) {
+	gzr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gzr.Close()
+
+	bundle := bundleFS{}
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := path.Clean(header.Name)
+		if !fs.ValidPath(name) {
+			return nil, fmt.Errorf("bundle: invalid file name: '%s'", header.Name)
+		}
+
+		if bundle[name], err = ioutil.ReadAll(tr); err != nil {
+			return nil, err
+		}
+	}
+	return bundle, nil
+}
+
+// BUNDLE FS -----------------------------------------------------------------------------------------------------------
+
+// bundleFS is an in-memory fs.FS, keys are the files
+// paths, directories are implied by them.
+type bundleFS map[string][]byte
+
+// Open implements fs.FS.
+func (b bundleFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	if data, isFile := b[name]; isFile {
+		return &bundleFile{info: bundleFileInfo{name: path.Base(name), size: int64(len(data))}, Reader: bytes.NewReader(data)}, nil
+	}
+
+	entries, err := b.ReadDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &bundleDir{info: bundleFileInfo{name: path.Base(name), dir: true}, entries: entries}, nil
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (b bundleFS) ReadFile(name string) ([]byte, error) {
+	data, isFile := b[name]
+	if !isFile {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte{}, data...), nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (b bundleFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	prefix := name + "/"
+	if name == "." {
+		prefix = ""
+	}
+
+	found := false
+	children := make(map[string]fs.DirEntry)
+	for file, data := range b {
+		if !strings.HasPrefix(file, prefix) {
+			continue
+		}
+		found = true
+
+		child := strings.TrimPrefix(file, prefix)
+		if i := strings.Index(child, "/"); i >= 0 {
+			children[child[:i]] = bundleFileInfo{name: child[:i], dir: true}
+		} else {
+			children[child] = bundleFileInfo{name: child, size: int64(len(data))}
+		}
+	}
+
+	if !found && name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(children))
+	for _, entry := range children {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// bundleFileInfo implements fs.FileInfo and fs.DirEntry.
+type bundleFileInfo struct {
+	name string
+	size int64
+	dir  bool
+}
+
+func (i bundleFileInfo) Name() string               { return i.name }
+func (i bundleFileInfo) Size() int64                { return i.size }
+func (i bundleFileInfo) ModTime() time.Time         { return time.Time{} }
+func (i bundleFileInfo) IsDir() bool                { return i.dir }
+func (i bundleFileInfo) Sys() interface{}           { return nil }
+func (i bundleFileInfo) Type() fs.FileMode          { return i.Mode().Type() }
+func (i bundleFileInfo) Info() (fs.FileInfo, error) { return i, nil }
+
+func (i bundleFileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// bundleFile is a file opened from a bundleFS.
+type bundleFile struct {
+	info bundleFileInfo
+	*bytes.Reader
+}
+
+func (f *bundleFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *bundleFile) Close() error               { return nil }
+
+// bundleDir is a directory opened from a bundleFS.
+type bundleDir struct {
+	info    bundleFileInfo
+	entries []fs.DirEntry
+}
+
+func (d *bundleDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *bundleDir) Close() error               { return nil }
+
+func (d *bundleDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *bundleDir) ReadDir(n int) (entries []fs.DirEntry, err error) {
+	if n <= 0 || n >= len(d.entries) {
+		entries, d.entries = d.entries, nil
+		if n > 0 && len(entries) == 0 {
+			err = io.EOF
+		}
+		return
+	}
+	entries, d.entries = d.entries[:n], d.entries[n:]
+	return
+}
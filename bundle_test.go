@@ -0,0 +1,79 @@
+package sprbox
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBundle(t *testing.T) {
+	BUILDENV = Development.ID()
+
+	writeConfigFile("config/Tool1.yml", "path: bundled", t)
+	writeConfigFile("config/Sub/Tool2.yml", "path: base", t)
+	writeConfigFile("config/Sub/Tool2.development.yml", "path: development", t)
+	defer removeConfigFiles(t)
+	defer SetBundlePublicKey(nil)
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bundlePath := filepath.Join(configPath, "config.tar.gz")
+	if err = CreateBundle(filepath.Join(configPath, "config"), bundlePath, privateKey); err != nil {
+		t.Fatal(err)
+	}
+
+	var test struct {
+		Tool1 fsTool
+		Sub   struct {
+			Tool2 fsTool `sprbox:"Sub/Tool2"`
+		}
+	}
+
+	assert.Equal(t, errNoBundlePublicKey, LoadToolBox(&test, bundlePath))
+
+	otherPublicKey, _, _ := ed25519.GenerateKey(nil)
+	SetBundlePublicKey(otherPublicKey)
+	assert.Equal(t, errBundleSignature, LoadToolBox(&test, bundlePath))
+
+	SetBundlePublicKey(publicKey)
+	if err = LoadToolBox(&test, bundlePath); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "bundled", test.Tool1.Config.Path)
+	assert.Equal(t, "development", test.Sub.Tool2.Config.Path)
+
+	// tampered bundle
+	data, _ := ioutil.ReadFile(bundlePath)
+	data[len(data)/2]++
+	if err = ioutil.WriteFile(bundlePath, data, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenBundle(bundlePath)
+	assert.Equal(t, errBundleSignature, err)
+
+	key, err := ParseBundlePublicKey(base64.StdEncoding.EncodeToString(publicKey) + "\n")
+	assert.NoError(t, err)
+	assert.Equal(t, publicKey, key)
+	_, err = ParseBundlePublicKey("invalid")
+	assert.Error(t, err)
+}
+
+func TestBundleFS(t *testing.T) {
+	bundle := bundleFS{
+		"Tool1.yml":          []byte("path: tool1"),
+		"Sub/Tool2.yml":      []byte("path: tool2"),
+		"Sub/Deep/Tool3.yml": []byte("path: tool3"),
+	}
+	if err := fstest.TestFS(bundle, "Tool1.yml", "Sub/Tool2.yml", "Sub/Deep/Tool3.yml"); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,150 @@
+// Command sprbox create signed config bundles
+// and embed the git info in binaries.
+//
+// Generate a key pair, the private key is written to <name>
+// and the public key to <name>.pub, both base64 encoded:
+//
+//	sprbox keygen bundle_key
+//
+// Package and sign a config directory:
+//
+//	sprbox bundle -key bundle_key -o config.tar.gz ./config
+//
+// The bundle can then be loaded with:
+//
+//	sprbox.SetBundlePublicKey(publicKey)
+//	sprbox.LoadToolBox(&ToolBox, "config.tar.gz")
+//
+// Print the -ldflags embedding the git info of the current repository,
+// so that the binary never exec git at runtime:
+//
+//	go build -ldflags "$(sprbox ldflags)" -o ./api_bin ./api
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/oblq/sprbox"
+)
+
+const usage = `usage:
+	sprbox keygen <name>
+	sprbox bundle -key <private_key> [-o config.tar.gz] <config_dir>
+	sprbox ldflags [repository_path]
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "keygen":
+		err = keygen(os.Args[2:])
+	case "bundle":
+		err = bundle(os.Args[2:])
+	case "ldflags":
+		err = ldflags(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// keygen write a new ed25519 key pair to <name> and <name>.pub.
+func keygen(args []string) error {
+	if len(args) != 1 {
+		return errors.New(usage)
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	if err = ioutil.WriteFile(args[0], []byte(base64.StdEncoding.EncodeToString(privateKey)+"\n"), 0600); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(args[0]+".pub", []byte(base64.StdEncoding.EncodeToString(publicKey)+"\n"), 0644); err != nil {
+		return err
+	}
+
+	fmt.Printf("private key: %s\npublic key: %s.pub\n", args[0], args[0])
+	return nil
+}
+
+// bundle package and sign a config directory.
+func bundle(args []string) error {
+	flags := flag.NewFlagSet("bundle", flag.ContinueOnError)
+	keyPath := flags.String("key", "", "the private key file")
+	out := flags.String("o", "config.tar.gz", "the bundle file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 || len(*keyPath) == 0 {
+		return errors.New(usage)
+	}
+
+	encoded, err := ioutil.ReadFile(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	privateKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(privateKey) != ed25519.PrivateKeySize {
+		return fmt.Errorf("invalid private key: %s", *keyPath)
+	}
+
+	if err = sprbox.CreateBundle(flags.Arg(0), *out, privateKey); err != nil {
+		return err
+	}
+
+	fmt.Printf("bundle: %s\nsignature: %s.sig\n", *out, *out)
+	return nil
+}
+
+// ldflags print the -ldflags embedding the git info, see sprbox.GitCommit.
+func ldflags(args []string) error {
+	if len(args) > 1 {
+		return errors.New(usage)
+	}
+
+	path := "."
+	if len(args) == 1 {
+		path = args[0]
+	}
+
+	repo := &sprbox.Repository{Path: path}
+	repo.UpdateInfo()
+	if repo.Error != nil {
+		return repo.Error
+	}
+
+	const pkg = "github.com/oblq/sprbox"
+	flags := []string{
+		fmt.Sprintf("-X %s.GitBranch=%s", pkg, repo.BranchName),
+		fmt.Sprintf("-X %s.GitCommit=%s", pkg, repo.Commit),
+		fmt.Sprintf("-X %s.GitTag=%s", pkg, repo.Tag),
+		fmt.Sprintf("-X %s.GitBuild=%s", pkg, repo.Build),
+		fmt.Sprintf("-X %s.GitHeadTags=%s", pkg, strings.Join(repo.HeadTags, ",")),
+	}
+
+	fmt.Println(strings.Join(flags, " "))
+	return nil
+}
@@ -1,17 +1,15 @@
 package sprbox
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
 	"strings"
-	"text/template"
 
 	"github.com/BurntSushi/toml"
 	"gopkg.in/yaml.v2"
@@ -36,6 +34,25 @@ const (
 	regexJSON = `(?i)(.json)`
 )
 
+// unmarshaler unmarshal data in a specific format to the config interface.
+type unmarshaler func(data []byte, config interface{}, filePath string) error
+
+// unmarshalerFor returns the unmarshaler for the given file extension.
+func unmarshalerFor(file string) (unmarshaler, error) {
+	ext := filepath.Ext(file)
+
+	switch {
+	case regexp.MustCompile(regexYAML).MatchString(ext):
+		return unmarshalYAML, nil
+	case regexp.MustCompile(regexTOML).MatchString(ext):
+		return unmarshalTOML, nil
+	case regexp.MustCompile(regexJSON).MatchString(ext):
+		return unmarshalJSON, nil
+	default:
+		return nil, fmt.Errorf("unknown data format, can't unmarshal file: '%s'", file)
+	}
+}
+
 func unmarshalJSON(data []byte, config interface{}, filePath string) (err error) {
 	return json.Unmarshal(data, config)
 }
@@ -131,74 +148,20 @@ func parseConfigTags(elem interface{}, indent string) error {
 	return nil
 }
 
-// parseTemplateBytes parse all text/template placeholders
-// (eg.: {{.Key}}) in config files.
-func parseTemplateBytes(file []byte, config interface{}) error {
-	var buf bytes.Buffer
-	var tpl *template.Template
-	var err error
-
-	if tpl, err = template.New("tpl").Parse(string(file)); err != nil {
-		return err
-	}
-
-	if err = tpl.Execute(&buf, config); err != nil {
-		return err
-	}
-
-	switch {
-	case unmarshalJSON(buf.Bytes(), config, "") == nil:
-		return nil
-	case unmarshalYAML(buf.Bytes(), config, "") == nil:
-		return nil
-	case unmarshalTOML(buf.Bytes(), config, "") == nil:
-		return nil
-	default:
-		return fmt.Errorf("the provided data is incompatible with an interface of type %T:\n%s",
-			config, strings.TrimSuffix(string(file), "\n"))
-	}
-}
-
-// parseTemplateFile parse all text/template placeholders
-// (eg.: {{.Key}}) in config files.
-func parseTemplateFile(file string, config interface{}) error {
-	var buf bytes.Buffer
-	var tpl *template.Template
-	var err error
-
-	if tpl, err = template.ParseFiles(file); err != nil {
-		return err
-	}
-	if err = tpl.Execute(&buf, config); err != nil {
-		return err
-	}
-
-	ext := filepath.Ext(file)
-
-	switch {
-	case regexp.MustCompile(regexYAML).MatchString(ext):
-		return unmarshalYAML(buf.Bytes(), config, file)
-	case regexp.MustCompile(regexTOML).MatchString(ext):
-		return unmarshalTOML(buf.Bytes(), config, file)
-	case regexp.MustCompile(regexJSON).MatchString(ext):
-		return unmarshalJSON(buf.Bytes(), config, file)
-	default:
-		return fmt.Errorf("unknown data format, can't unmarshal file: '%s'", file)
-	}
-}
-
 // Unmarshal will unmarshal []byte to interface
 // for yaml, toml and json data formats.
 //
 // Will also parse struct flags.
 func Unmarshal(data []byte, config interface{}) (err error) {
+	var unmarshal unmarshaler
+
 	switch {
 	case unmarshalJSON(data, config, "") == nil:
-		break
+		unmarshal = unmarshalJSON
 	case unmarshalYAML(data, config, "") == nil:
-		break
+		unmarshal = unmarshalYAML
 	case unmarshalTOML(data, config, "") == nil:
-		break
+		unmarshal = unmarshalTOML
 	default:
 		return fmt.Errorf("the provided data is incompatible with an interface of type %T:\n%s",
 			config, strings.TrimSuffix(string(data), "\n"))
@@ -206,7 +169,7 @@ func Unmarshal(data []byte, config interface{}) (err error) {
 
 	//debugPrintf("elem: %s\n%+v\n", string(data), config)
 
-	if err = parseTemplateBytes(data, config); err != nil {
+	if err = resolveTemplates(data, config, "tpl", unmarshal, nil); err != nil {
 		return err
 	}
 	return parseConfigTags(config, "")
@@ -218,37 +181,79 @@ func Unmarshal(data []byte, config interface{}) (err error) {
 // Build-environment specific files will override generic files.
 // The latest files will override the earliest.
 //
+// Relative files are searched in the config search paths,
+// if any, see SetConfigSearchPaths().
+// Files in the default config fs.FS, if any, are layered
+// under the OS ones, see SetDefaultConfigFS().
+//
 // Will also parse struct flags.
 func LoadConfig(config interface{}, files ...string) (err error) {
-	foundFiles := configFilesByEnv(files...)
-	if len(foundFiles) == 0 {
-		return fmt.Errorf("no config file found for '%s'", strings.Join(files, " | "))
+	return loadConfig(configFSs(), nil, false, config, files...)
+}
+
+// LoadConfigSectioned is like LoadConfig but all the files
+// are divided in environment sections, the top-level keys are
+// environment ids (plus `default`), as the files
+// containing the `sprbox: sectioned` marker.
+// Files with neither the `default` nor the current environment
+// section return an error.
+func LoadConfigSectioned(config interface{}, files ...string) (err error) {
+	return loadConfig(configFSs(), nil, true, config, files...)
+}
+
+// LoadConfigFS is like LoadConfig but the files are
+// searched in fsys (eg.: an embed.FS or a fstest.MapFS),
+// using slash-separated paths relative to its root.
+//
+// In the 'configurableFS' interface implementations pass the
+// received fs.FS and config files as they are, the files are
+// searched in the same file systems of the toolbox
+// and the 'ref' template func is available.
+func LoadConfigFS(fsys fs.FS, config interface{}, files ...string) (err error) {
+	if tbFS, isToolBoxFS := fsys.(*toolBoxFS); isToolBoxFS {
+		return loadConfig(tbFS.fss, tbFS.refs, false, config, files...)
 	}
+	return loadConfig([]fs.FS{fsys}, nil, false, config, files...)
+}
 
-	for _, file := range foundFiles {
-		var in []byte
-		if in, err = ioutil.ReadFile(file); err != nil {
+// loadConfig unmarshal the files found in every
+// file system in fss to the config interface,
+// if sectioned all the files are divided in environment sections.
+// The 'ref' template func is resolved by refs, if any.
+func loadConfig(fss []fs.FS, refs *refResolver, sectioned bool, config interface{}, files ...string) (err error) {
+	var found int
+	var layers []configLayer
+	for _, fsys := range fss {
+		var foundFiles []string
+		if foundFiles, err = searchConfigFiles(fsys, files...); err != nil {
 			return err
 		}
+		found += len(foundFiles)
 
-		ext := filepath.Ext(file)
-
-		switch {
-		case regexp.MustCompile(regexYAML).MatchString(ext):
-			err = unmarshalYAML(in, config, file)
-		case regexp.MustCompile(regexTOML).MatchString(ext):
-			err = unmarshalTOML(in, config, file)
-		case regexp.MustCompile(regexJSON).MatchString(ext):
-			err = unmarshalJSON(in, config, file)
-		default:
-			err = fmt.Errorf("unknown data format, can't unmarshal file: '%s'", file)
+		for _, file := range foundFiles {
+			var fLayers []configLayer
+			if fLayers, err = fileLayers(fsys, file, sectioned); err != nil {
+				return err
+			}
+			layers = append(layers, fLayers...)
+		}
+	}
+
+	if found == 0 {
+		return fmt.Errorf("no config file found for '%s'", strings.Join(files, " | "))
+	}
+
+	for _, layer := range layers {
+		var unmarshal unmarshaler
+		if unmarshal, err = unmarshalerFor(layer.file); err != nil {
+			return err
 		}
 
-		if err != nil {
+		if err = unmarshal(layer.data, config, layer.file); err != nil {
 			return err
 		}
 
-		if err = parseTemplateFile(file, config); err != nil {
+		if err = resolveTemplates(layer.data, config, filepath.Base(layer.file), unmarshal, refs); err != nil {
 			return err
 		}
 	}
@@ -264,3 +269,21 @@ func LoadConfig(config interface{}, files ...string) (err error) {
 	defer debugPrintf("%s\n", green(dump(config)))
 	return parseConfigTags(config, "")
 }
+
+// LoadConfigDir will unmarshal all the config files in dir
+// (eg.: conf.d/00-base.yml, conf.d/50-tuning.yml)
+// to the config interface, in lexicographic order.
+//
+// Build-environment specific files (eg.: conf.d/50-tuning.production.yml)
+// will override their generic file.
+//
+// Will also parse struct flags.
+func LoadConfigDir(config interface{}, dir string) error {
+	files, err := configDirFiles(dir)
+	if err != nil {
+		return err
+	} else if len(files) == 0 {
+		return fmt.Errorf("no config file found in '%s'", dir)
+	}
+	return LoadConfig(config, files...)
+}
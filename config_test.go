@@ -353,34 +353,34 @@ func TestEnvironmentFiles(t *testing.T) {
 	defer removeConfigFiles(t)
 
 	// '<path>/<file>.<environment>.*'
-	if files := configFilesByEnv(filepath.Join(configPath, "tool")); len(files) == 1 {
+	if files, _ := configFilesByEnv(osFS{}, filepath.Join(configPath, "tool")); len(files) == 1 {
 		if files[0] != filepath.Join(configPath, "tool."+Env().ID()+".json") {
 			t.Error("file not matched")
 		}
 	}
 
 	// '<path>/<file>.*'
-	if files := configFilesByEnv(filepath.Join(configPath, "tool1")); len(files) == 1 {
+	if files, _ := configFilesByEnv(osFS{}, filepath.Join(configPath, "tool1")); len(files) == 1 {
 		if files[0] != filepath.Join(configPath, "tool1.yaml") {
 			t.Error("file not matched")
 		}
 	}
 
 	// '<path>/<file>.<ext>'
-	if files := configFilesByEnv(filepath.Join(configPath, "tool.toml")); len(files) == 1 {
+	if files, _ := configFilesByEnv(osFS{}, filepath.Join(configPath, "tool.toml")); len(files) == 1 {
 		if files[0] != filepath.Join(configPath, "tool.toml") {
 			t.Error("file not matched")
 		}
 	}
 
 	// wrong ext '<path>/<file>.<ext>'
-	if files := configFilesByEnv(filepath.Join(configPath, "tool2.toml")); len(files) > 1 {
+	if files, _ := configFilesByEnv(osFS{}, filepath.Join(configPath, "tool2.toml")); len(files) > 1 {
 		t.Error("file not matched")
 	}
 
 	// case insensitive '<path>/<file>.<environment>.*'
 	fileSearchCaseSensitive = false
-	if files := configFilesByEnv(filepath.Join(configPath, "TOOL")); len(files) == 1 {
+	if files, _ := configFilesByEnv(osFS{}, filepath.Join(configPath, "TOOL")); len(files) == 1 {
 		if files[0] != filepath.Join(configPath, "tool."+Env().ID()+".json") {
 			t.Error("file not matched")
 		}
@@ -651,3 +651,29 @@ func TestConfigWTemplates(t *testing.T) {
 	assert.Equal(t, expected, uResult.TStruct.Text, "error in template parsing: %+v", uResult.TStruct.Text)
 	assert.Equal(t, expected, uResult.TStruct.TStruct2.Text, "error in template parsing: %+v", uResult.TStruct.TStruct2.Text)
 }
+
+func TestConfigWTemplateContext(t *testing.T) {
+	SetTemplateContext(true)
+	defer SetTemplateContext(false)
+
+	config := ConfigWTemplates{
+		Text1:     "Hello",
+		Text2:     "{{.Config.Text1}} world!",
+		TextSlice: []string{"{{.Config.Text1}} world!"},
+		TextMap:   map[string]string{"text": "{{.Config.Text1}} world!"},
+	}
+	fileName := "config.yaml"
+	createYAML(config, fileName, t)
+	defer removeConfigFiles(t)
+
+	var result ConfigWTemplates
+	if err := LoadConfig(&result, filepath.Join(configPath, fileName)); err != nil {
+		t.Error(err)
+	}
+
+	expected := "Hello world!"
+
+	assert.Equal(t, expected, result.Text2, "error in template parsing: %+v", result.Text2)
+	assert.Equal(t, expected, result.TextSlice[0], "error in template parsing: %+v", result.TextSlice[0])
+	assert.Equal(t, expected, result.TextMap["text"], "error in template parsing: %+v", result.TextMap["text"])
+}
@@ -0,0 +1,301 @@
+package sprbox
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// EnvResolver returns the tag matched against the
+// registered environments to select the current one.
+type EnvResolver interface {
+	// Name describe the tag source (eg.: "git branch name").
+	Name() string
+
+	// Resolve returns the tag, ok is false if the tag
+	// can't be determined by the resolver,
+	// the next one in the chain will be used in that case.
+	Resolve() (tag string, ok bool)
+}
+
+// envResolver is a func based EnvResolver.
+type envResolver struct {
+	name    string
+	resolve func() (string, bool)
+}
+
+func (r envResolver) Name() string                   { return r.name }
+func (r envResolver) Resolve() (tag string, ok bool) { return r.resolve() }
+
+// NewEnvResolver returns an EnvResolver from a func.
+func NewEnvResolver(name string, resolve func() (tag string, ok bool)) EnvResolver {
+	return envResolver{name: name, resolve: resolve}
+}
+
+// envResolvers is the resolvers chain, see SetEnvResolvers().
+var envResolvers = DefaultEnvResolvers()
+
+// DefaultEnvResolvers returns the default resolvers chain:
+// the BUILDENV var, the BUILD_ENV environment variable,
+// the git branch name, the git tags and the test binary name.
+//
+// TestingResolver is not in the chain, so that `go test` in a
+// git checkout selects the environment by branch, as any other run.
+func DefaultEnvResolvers() []EnvResolver {
+	return []EnvResolver{
+		LdflagsResolver(),
+		EnvVarResolver(EnvVarKey),
+		GitBranchResolver(),
+		GitTagResolver(),
+		BinaryNameResolver(),
+	}
+}
+
+// LdflagsResolver returns the BUILDENV var,
+// set manually or interpolated with -ldflags.
+func LdflagsResolver() EnvResolver {
+	return NewEnvResolver("'BUILDENV' var", func() (string, bool) {
+		return BUILDENV, len(BUILDENV) > 0
+	})
+}
+
+// EnvVarResolver returns the value of the given environment variable.
+func EnvVarResolver(key string) EnvResolver {
+	return NewEnvResolver(fmt.Sprintf("'%s' environment variable", key), func() (string, bool) {
+		tag := os.Getenv(key)
+		return tag, len(tag) > 0
+	})
+}
+
+// GitBranchResolver returns the VCS branch name,
+// on a detached HEAD the next resolver is used.
+func GitBranchResolver() EnvResolver {
+	return NewEnvResolver("git branch name", func() (string, bool) {
+		if VCS == nil || VCS.Error != nil || VCS.BranchName == "HEAD" {
+			return "", false
+		}
+		return VCS.BranchName, len(VCS.BranchName) > 0
+	})
+}
+
+// GitTagResolver returns the first VCS tag pointing at HEAD (Repository.HeadTags)
+// matching a registered environment, see Environment.SetTagExps().
+// Repository.Tag is not used, it is the latest reachable tag,
+// not necessarily one pointing at HEAD.
+func GitTagResolver() EnvResolver {
+	return NewEnvResolver("git tag", func() (string, bool) {
+		if VCS == nil || VCS.Error != nil {
+			return "", false
+		}
+
+		for _, tag := range VCS.HeadTags {
+			for _, env := range Environments() {
+				if env.MatchTag(tag) {
+					return tag, true
+				}
+			}
+		}
+		return "", false
+	})
+}
+
+// HostnameResolver returns the machine hostname,
+// only if it match a registered environment.
+func HostnameResolver() EnvResolver {
+	return NewEnvResolver("hostname", func() (string, bool) {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return "", false
+		}
+
+		for _, env := range Environments() {
+			if env.MatchTag(hostname) {
+				return hostname, true
+			}
+		}
+		return "", false
+	})
+}
+
+// Kubernetes files, can be changed if mounted elsewhere.
+var (
+	// KubernetesNamespaceFile is the service-account namespace file.
+	KubernetesNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+
+	// KubernetesLabelsFile is the pod labels file exposed
+	// through the Downward API (eg.: with a 'podinfo' volume).
+	KubernetesLabelsFile = "/etc/podinfo/labels"
+)
+
+// KubernetesLabels are the pod labels checked by
+// default by KubernetesResolver(), in that order.
+var KubernetesLabels = []string{"app.kubernetes.io/environment", "environment", "env"}
+
+// KubernetesResolver returns the id of the environment named by the first
+// pod label in labels (KubernetesLabels if none) or else by a dash-separated
+// segment of the pod namespace (eg.: 'shop-staging' -> 'staging').
+// Environment ids are matched exactly (case-insensitive), not by their RegEx,
+// so that 'payments-devops' does not select Development through 'dev'.
+// Outside of a pod the next resolver is used.
+//
+// The files are read once, on the first resolution.
+// It is not in the default resolvers chain, add it with SetEnvResolvers().
+func KubernetesResolver(labels ...string) EnvResolver {
+	var once sync.Once
+	var tags []string
+
+	return NewEnvResolver("kubernetes pod", func() (string, bool) {
+		once.Do(func() {
+			keys := labels
+			if len(keys) == 0 {
+				keys = KubernetesLabels
+			}
+
+			podLabels := kubernetesLabels(KubernetesLabelsFile)
+			for _, key := range keys {
+				if value, ok := podLabels[key]; ok {
+					tags = append(tags, value)
+				}
+			}
+
+			if data, err := ioutil.ReadFile(KubernetesNamespaceFile); err == nil {
+				tags = append(tags, strings.Split(strings.TrimSpace(string(data)), "-")...)
+			}
+		})
+
+		for _, tag := range tags {
+			if env := lookupEnvironment(tag); env != nil && len(tag) > 0 {
+				return env.ID(), true
+			}
+		}
+		return "", false
+	})
+}
+
+// kubernetesLabels parse a Downward API labels file,
+// one 'key="value"' pair per line.
+func kubernetesLabels(path string) map[string]string {
+	labels := make(map[string]string)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return labels
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		kv := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		value, err := strconv.Unquote(kv[1])
+		if err != nil {
+			value = kv[1]
+		}
+		labels[kv[0]] = value
+	}
+	return labels
+}
+
+// BinaryNameResolver returns the Testing environment id
+// if the running binary is a test binary (eg.: sprbox.test).
+func BinaryNameResolver() EnvResolver {
+	return NewEnvResolver("running file name", func() (string, bool) {
+		return Testing.ID(), testingRegexp.MatchString(os.Args[0])
+	})
+}
+
+// TestingResolver returns the Testing environment id
+// if the program is running as a test (the 'go test' flags are registered),
+// regardless of the binary name.
+//
+// The flags are registered by testing.Init(), called by the test main,
+// so tests are not detected in package init() functions and var declarations.
+func TestingResolver() EnvResolver {
+	return NewEnvResolver("test flags", func() (string, bool) {
+		return Testing.ID(), flag.Lookup("test.v") != nil
+	})
+}
+
+// MarkerFileResolver returns the content of the
+// given file (eg.: /etc/sprbox.env), if it exists.
+func MarkerFileResolver(path string) EnvResolver {
+	return NewEnvResolver(fmt.Sprintf("marker file '%s'", path), func() (string, bool) {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", false
+		}
+		tag := strings.TrimSpace(string(data))
+		return tag, len(tag) > 0
+	})
+}
+
+// EnvResolution is the result of the environment resolution.
+type EnvResolution struct {
+	// Env is the selected environment.
+	Env *Environment
+
+	// Tag is the tag matched against the registered environments.
+	Tag string
+
+	// Resolver is the name of the resolver that returned the tag,
+	// empty if no resolver returned a tag.
+	Resolver string
+
+	// Matched is false if the tag did not match any environment,
+	// the default environment is selected in that case.
+	Matched bool
+}
+
+// String returns a description of the resolution.
+func (r EnvResolution) String() string {
+	if len(r.Resolver) == 0 {
+		return fmt.Sprintf("<empty>, default environment is '%s'.", r.Env.ID())
+	} else if !r.Matched {
+		return fmt.Sprintf("'%s', inferred from %s, not matched, default environment is '%s'.",
+			r.Tag, r.Resolver, r.Env.ID())
+	}
+	return fmt.Sprintf("'%s', inferred from %s.", r.Tag, r.Resolver)
+}
+
+// ResolveEnv select the current environment by matching the tag
+// returned by the first resolver in the chain able to determine it
+// against the registered environments RegEx, in priority order (see Environments()).
+// If no environment match, the default one is selected
+// (Local by default, see SetDefaultEnvironment()).
+func ResolveEnv() (resolution EnvResolution) {
+	environmentsFileOnce.Do(loadEnvironmentsFile)
+
+	mutex.Lock()
+	resolvers := envResolvers
+	mutex.Unlock()
+
+	for _, resolver := range resolvers {
+		if tag, ok := resolver.Resolve(); ok {
+			resolution.Tag = tag
+			resolution.Resolver = resolver.Name()
+			break
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	resolution.Env = defaultEnvironment
+	if len(resolution.Resolver) > 0 {
+		for _, env := range sortedEnvironments() {
+			if env.MatchTag(resolution.Tag) {
+				resolution.Env = env
+				resolution.Matched = true
+				break
+			}
+		}
+	}
+
+	privateTAG = resolution.Tag
+	inferredBy = resolution.String()
+	return
+}
@@ -2,9 +2,10 @@ package sprbox
 
 import (
 	"fmt"
-	"os"
+	"io/ioutil"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -33,8 +34,9 @@ var (
 	BUILDENV = ""
 
 	// VCS is the project version control system.
-	// By default it uses the working directory.
-	VCS = NewRepository("./")
+	// By default it uses the git info embedded at build time, if any,
+	// (see EmbeddedRepository()) or else the working directory.
+	VCS = defaultRepository()
 
 	privateTAG = ""
 
@@ -43,14 +45,25 @@ var (
 
 // Default environment's configuration
 var (
-	Production  = &Environment{id: "production", exps: []string{"production", "master"}, RunCompiled: true}
-	Staging     = &Environment{id: "staging", exps: []string{"staging", "release/*", "hotfix/*"}, RunCompiled: true}
-	Testing     = &Environment{id: "testing", exps: []string{"testing", "test"}, RunCompiled: false}
-	Development = &Environment{id: "development", exps: []string{"development", "develop", "dev", "feature/*"}, RunCompiled: false}
-	Local       = &Environment{id: "local", exps: []string{"local"}, RunCompiled: false}
+	Production  = &Environment{id: "production", exps: []string{"production", "master"}, RunCompiled: true, Priority: 50}
+	Staging     = &Environment{id: "staging", exps: []string{"staging", "release/*", "hotfix/*"}, RunCompiled: true, Priority: 40}
+	Testing     = &Environment{id: "testing", exps: []string{"testing", "test"}, RunCompiled: false, Priority: 30}
+	Development = &Environment{id: "development", exps: []string{"development", "develop", "dev", "feature/*"}, RunCompiled: false, LocalOverrides: true, Priority: 20}
+	Local       = &Environment{id: "local", exps: []string{"local"}, RunCompiled: false, LocalOverrides: true, Priority: 10}
 )
 
+// environments is the environments registry,
+// see RegisterEnvironment() and UnregisterEnvironment().
+var environments = []*Environment{Production, Staging, Testing, Development, Local}
+
+// defaultEnvironment is selected if no environment
+// match the tag, see SetDefaultEnvironment().
+var defaultEnvironment = Local
+
 func init() {
+	Production.SetTagExps([]string{`^v?\d+\.\d+\.\d+$`})
+	Staging.SetTagExps([]string{`^v?\d+\.\d+\.\d+-rc(\.\d+)?$`})
+
 	Production.compileExps()
 	Staging.compileExps()
 	Testing.compileExps()
@@ -58,51 +71,90 @@ func init() {
 	Local.compileExps()
 }
 
-var testingRegexp = regexp.MustCompile(`_test|(\.test$)|_Test`)
-var inferredBy string
+// NewEnvironment returns a new environment, matched by the given
+// regular expressions, to be registered with RegisterEnvironment():
+//  qa := sprbox.NewEnvironment("qa", []string{"qa", "qa/*"}, true)
+//  qa.Priority = 45
+//  sprbox.RegisterEnvironment(qa)
+//
+// If no exps are passed the environment is matched by its id.
+func NewEnvironment(id string, exps []string, runCompiled bool) *Environment {
+	if len(exps) == 0 {
+		exps = []string{id}
+	}
+	env := &Environment{id: id, exps: exps, RunCompiled: runCompiled}
+	env.compileExps()
+	return env
+}
 
-// Env returns the current selected environment by
-// matching the privateTAG variable against the environments RegEx.
-func Env() *Environment {
+// RegisterEnvironment add the environment to the registry,
+// replacing any registered environment with the same id.
+func RegisterEnvironment(env *Environment) {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	// loading tag
-	if len(BUILDENV) > 0 {
-		privateTAG = BUILDENV
-		inferredBy = fmt.Sprintf("'%s', inferred from 'BUILDENV' var, set manually.", privateTAG)
-		//return
-	} else if privateTAG = os.Getenv(EnvVarKey); len(privateTAG) > 0 {
-		inferredBy = fmt.Sprintf("'%s', inferred from '%s' environment variable.", privateTAG, EnvVarKey)
-		//return
-	} else if VCS != nil {
-		if VCS.Error == nil {
-			privateTAG = VCS.BranchName
-			inferredBy = fmt.Sprintf("<empty>, inferred from git.BranchName (%s).", VCS.BranchName)
-			//return
-		}
-	} else if testingRegexp.MatchString(os.Args[0]) {
-		privateTAG = Testing.ID()
-		inferredBy = fmt.Sprintf("'%s', inferred from the running file name (%s).", privateTAG, os.Args[0])
-		//return
-	} else {
-		inferredBy = "<empty>, default environment is 'local'."
-	}
-
-	switch {
-	case Production.MatchTag(privateTAG):
-		return Production
-	case Staging.MatchTag(privateTAG):
-		return Staging
-	case Testing.MatchTag(privateTAG):
-		return Testing
-	case Development.MatchTag(privateTAG):
-		return Development
-	case Local.MatchTag(privateTAG):
-		return Local
-	default:
-		return Local
+	for i, registered := range environments {
+		if strings.EqualFold(registered.ID(), env.ID()) {
+			environments[i] = env
+			return
+		}
 	}
+	environments = append(environments, env)
+}
+
+// UnregisterEnvironment remove the environment with the given id
+// from the registry, built-in environments can be removed too.
+func UnregisterEnvironment(id string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for i, registered := range environments {
+		if strings.EqualFold(registered.ID(), id) {
+			environments = append(environments[:i:i], environments[i+1:]...)
+			return
+		}
+	}
+}
+
+// lookupEnvironment returns the registered environment with the given id.
+func lookupEnvironment(id string) *Environment {
+	for _, env := range Environments() {
+		if strings.EqualFold(env.ID(), id) {
+			return env
+		}
+	}
+	return nil
+}
+
+// Environments returns the registered environments, in match order:
+// higher Priority first, then in registration order.
+func Environments() []*Environment {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return sortedEnvironments()
+}
+
+// sortedEnvironments returns the registered environments in match order,
+// the caller must hold the mutex.
+func sortedEnvironments() []*Environment {
+	sorted := append([]*Environment{}, environments...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Priority > sorted[j].Priority
+	})
+	return sorted
+}
+
+var testingRegexp = regexp.MustCompile(`_test|(\.test$)|_Test`)
+var inferredBy string
+
+// Env returns the current selected environment by
+// matching the tag returned by the resolvers chain
+// against the registered environments RegEx,
+// in priority order (see Environments() and SetEnvResolvers()).
+// If no environment match, the default one is returned
+// (Local by default, see SetDefaultEnvironment()).
+func Env() *Environment {
+	return ResolveEnv().Env
 }
 
 // EnvSubDir returns <path>/<environment>
@@ -146,6 +198,10 @@ type Environment struct {
 	exps   []string
 	regexp *regexp.Regexp
 
+	// tagExps match the git tags of release builds.
+	tagExps   []string
+	tagRegexp *regexp.Regexp
+
 	// RunCompiled true means that the program run from
 	// a precompiled binary for that environment.
 	// CompiledPath() returns the path base if RunCompiled == true
@@ -155,12 +211,57 @@ type Environment struct {
 	//
 	// By default only Production and Staging environments have RunCompiled = true.
 	RunCompiled bool
+
+	// LocalOverrides true means that the local, git-ignored,
+	// config files (eg.: Services.local.yml and Services.<environment>.local.yml)
+	// are layered over the others.
+	//
+	// By default only Development and Local environments have LocalOverrides = true.
+	LocalOverrides bool
+
+	// Priority determine the match order of the registered environments,
+	// higher first, environments with the same priority are matched
+	// in registration order.
+	//
+	// Default environments have: Production 50, Staging 40, Testing 30,
+	// Development 20 and Local 10.
+	Priority int
+
+	// parent is the parent environment id.
+	parent string
+
+	// attrs are arbitrary environment attributes.
+	attrs map[string]interface{}
 }
 
 // MatchTag check if the passed tag match that environment,
 // a tag may be the branch name or the machine hostname or whatever you want.
+// Git tags are also matched against the environment tag RegEx, see SetTagExps().
 func (e *Environment) MatchTag(tag string) bool {
-	return e.regexp.MatchString(tag)
+	return e.regexp.MatchString(tag) || e.MatchGitTag(tag)
+}
+
+// MatchGitTag check if the passed git tag match that environment tag RegEx.
+func (e *Environment) MatchGitTag(tag string) bool {
+	return e.tagRegexp != nil && e.tagRegexp.MatchString(tag)
+}
+
+// AppendTagExp add a regular expression to match the git tags of that environment.
+func (e *Environment) AppendTagExp(exp string) {
+	e.SetTagExps(append(e.tagExps, exp))
+}
+
+// SetTagExps set regular expressions to match the git tags
+// of that environment (eg.: release builds from a detached HEAD).
+//
+// By default final semver tags (v1.4.0) match Production
+// and release candidates (v1.4.0-rc.1) match Staging.
+func (e *Environment) SetTagExps(exps []string) {
+	e.tagExps = exps
+	e.tagRegexp = nil
+	if len(exps) > 0 {
+		e.tagRegexp = regexp.MustCompile("(" + strings.Join(exps, ")|(") + ")")
+	}
 }
 
 // AppendExp add a regular expression to match that environment.
@@ -186,6 +287,56 @@ func (e *Environment) ID() string {
 	return e.id
 }
 
+// Parent returns the registered parent environment, if any.
+func (e *Environment) Parent() *Environment {
+	if len(e.parent) == 0 {
+		return nil
+	}
+	return lookupEnvironment(e.parent)
+}
+
+// SetParent set the parent environment id,
+// config files and attributes fall back to the parent ones.
+func (e *Environment) SetParent(id string) {
+	e.parent = id
+}
+
+// Chain returns the environment ancestors, from the root one,
+// and the environment itself (eg.: [production, preprod]).
+// Parent cycles are ignored.
+func (e *Environment) Chain() []*Environment {
+	chain := []*Environment{e}
+	for parent := e.Parent(); parent != nil; parent = parent.Parent() {
+		for _, env := range chain {
+			if env == parent {
+				return chain
+			}
+		}
+		chain = append([]*Environment{parent}, chain...)
+	}
+	return chain
+}
+
+// Attr returns the environment attribute for the given key,
+// falling back to the parent environments ones.
+func (e *Environment) Attr(key string) interface{} {
+	chain := e.Chain()
+	for i := len(chain) - 1; i >= 0; i-- {
+		if value, ok := chain[i].attrs[key]; ok {
+			return value
+		}
+	}
+	return nil
+}
+
+// SetAttr set an environment attribute.
+func (e *Environment) SetAttr(key string, value interface{}) {
+	if e.attrs == nil {
+		e.attrs = make(map[string]interface{})
+	}
+	e.attrs[key] = value
+}
+
 // Info return some environment info.
 func (e *Environment) Info() string {
 	return fmt.Sprintf("%s - tag: %s\n", strings.ToUpper(e.ID()), inferredBy)
@@ -198,3 +349,117 @@ func (e *Environment) PrintInfo() {
 	envLog.Println("Environment:", info)
 	//envLog.Println("Config path:", ansi.Green(ConfigPathByEnv(configPath))+"\n")
 }
+
+// ENVIRONMENTS FILE ---------------------------------------------------------------------------------------------------
+
+// environmentsFileNames are the names of the environments files
+// automatically loaded from the working directory, in any supported format.
+var environmentsFileNames = []string{".sprbox", "environments"}
+
+var environmentsFileOnce sync.Once
+
+// environmentsConfig is the environments file content:
+//  environments:
+//    - id: qa
+//      exps: [qa, release/qa-*]
+//      tagExps: [-qa\.\d+$]
+//      runCompiled: true
+//      priority: 45
+//      parent: staging
+//      attributes:
+//        region: eu-west
+type environmentsConfig struct {
+	Environments []struct {
+		ID             string                 `yaml:"id" json:"id" toml:"id"`
+		Exps           []string               `yaml:"exps" json:"exps" toml:"exps"`
+		TagExps        []string               `yaml:"tagExps" json:"tagExps" toml:"tagExps"`
+		RunCompiled    *bool                  `yaml:"runCompiled" json:"runCompiled" toml:"runCompiled"`
+		LocalOverrides *bool                  `yaml:"localOverrides" json:"localOverrides" toml:"localOverrides"`
+		Priority       *int                   `yaml:"priority" json:"priority" toml:"priority"`
+		Parent         string                 `yaml:"parent" json:"parent" toml:"parent"`
+		Attributes     map[string]interface{} `yaml:"attributes" json:"attributes" toml:"attributes"`
+	} `yaml:"environments" json:"environments" toml:"environments"`
+}
+
+// loadEnvironmentsFile load the first environments file
+// found in the working directory, if any.
+func loadEnvironmentsFile() {
+	for _, name := range environmentsFileNames {
+		regex := regexp.MustCompile(fmt.Sprintf("^%s%s$", regexp.QuoteMeta(name), extRegexp))
+		file, err := walkConfigPath(osFS{}, ".", regex)
+		if err == nil && len(file) > 0 {
+			err = LoadEnvironments(file)
+		}
+
+		if err != nil {
+			fmt.Printf("%s %s\n", red("environments file:"), err.Error())
+		}
+		if len(file) > 0 {
+			return
+		}
+	}
+}
+
+// LoadEnvironments register the environments defined in the given file
+// (eg.: environments.yml), already registered environments
+// with the same id are updated.
+// Files named `.sprbox.*` or `environments.*` in the
+// working directory are loaded automatically.
+func LoadEnvironments(file string) error {
+	unmarshal, err := unmarshalerFor(file)
+	if err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var config environmentsConfig
+	if err = unmarshal(data, &config, file); err != nil {
+		return err
+	}
+
+	// validate all the environments before registering any of them
+	for _, envConfig := range config.Environments {
+		if len(envConfig.ID) == 0 {
+			return fmt.Errorf("%s: environment id is required", file)
+		}
+		for _, exp := range append(append([]string{}, envConfig.Exps...), envConfig.TagExps...) {
+			if _, err = regexp.Compile(exp); err != nil {
+				return fmt.Errorf("%s: environment '%s': %s", file, envConfig.ID, err.Error())
+			}
+		}
+	}
+
+	for _, envConfig := range config.Environments {
+		env := lookupEnvironment(envConfig.ID)
+		if env == nil {
+			env = NewEnvironment(envConfig.ID, envConfig.Exps, false)
+			RegisterEnvironment(env)
+		} else if len(envConfig.Exps) > 0 {
+			env.SetExps(envConfig.Exps)
+		}
+
+		if len(envConfig.TagExps) > 0 {
+			env.SetTagExps(envConfig.TagExps)
+		}
+		if envConfig.RunCompiled != nil {
+			env.RunCompiled = *envConfig.RunCompiled
+		}
+		if envConfig.LocalOverrides != nil {
+			env.LocalOverrides = *envConfig.LocalOverrides
+		}
+		if envConfig.Priority != nil {
+			env.Priority = *envConfig.Priority
+		}
+		if len(envConfig.Parent) > 0 {
+			env.SetParent(envConfig.Parent)
+		}
+		for key, value := range envConfig.Attributes {
+			env.SetAttr(key, normalize(value))
+		}
+	}
+	return nil
+}
@@ -1,13 +1,51 @@
 package sprbox
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
+	"regexp"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// saveEnvironments restore, at the end of the test, the environments
+// registry, the default environment, the resolvers chain, the built-in
+// environments (exps, tag exps, attributes...), BUILDENV, VCS
+// and the BUILD_ENV environment variable.
+func saveEnvironments(t *testing.T) {
+	builtins := []*Environment{Production, Staging, Testing, Development, Local}
+	saved := make([]Environment, len(builtins))
+	for i, env := range builtins {
+		saved[i] = *env
+		saved[i].attrs = make(map[string]interface{}, len(env.attrs))
+		for key, value := range env.attrs {
+			saved[i].attrs[key] = value
+		}
+	}
+	registry := append([]*Environment{}, environments...)
+	defaultEnv, resolvers := defaultEnvironment, envResolvers
+	buildEnv, vcs := BUILDENV, VCS
+	envVar, envVarSet := os.LookupEnv(EnvVarKey)
+
+	t.Cleanup(func() {
+		for i, env := range builtins {
+			*env = saved[i]
+		}
+		environments, defaultEnvironment, envResolvers = registry, defaultEnv, resolvers
+		BUILDENV, VCS = buildEnv, vcs
+		if envVarSet {
+			os.Setenv(EnvVarKey, envVar)
+		} else {
+			os.Unsetenv(EnvVarKey)
+		}
+	})
+}
+
 func TestEnvironment(t *testing.T) {
+	saveEnvironments(t)
+
 	BUILDENV = Local.ID()
 	assert.Equal(t, Env(), Local, "Local environment not matched")
 
@@ -53,6 +91,8 @@ func TestEnvironment(t *testing.T) {
 }
 
 func TestCompiledPath(t *testing.T) {
+	saveEnvironments(t)
+
 	BUILDENV = Local.ID()
 	assert.Equal(t,
 		"../static_files/config",
@@ -65,3 +105,242 @@ func TestCompiledPath(t *testing.T) {
 		CompiledPath("../static_files/config"),
 		"compiledPath in RunCompiled environments is wrong")
 }
+
+func TestEnvironmentRegistry(t *testing.T) {
+	saveEnvironments(t)
+
+	qa := NewEnvironment("qa", []string{"qa", "release/qa-*"}, true)
+	qa.Priority = 45
+	RegisterEnvironment(qa)
+	RegisterEnvironment(NewEnvironment("sandbox", []string{"sandbox"}, false))
+
+	BUILDENV = "qa"
+	assert.Equal(t, qa, Env())
+
+	// qa has priority over staging ("release/*")
+	BUILDENV = "release/qa-1"
+	assert.Equal(t, qa, Env())
+	BUILDENV = "release/1.0"
+	assert.Equal(t, Staging, Env())
+
+	BUILDENV = "sandbox"
+	assert.Equal(t, "sandbox", Env().ID())
+	assert.True(t, isEnvID("sandbox"))
+
+	// replace by id
+	preprod := NewEnvironment("qa", []string{"preprod"}, true)
+	RegisterEnvironment(preprod)
+	BUILDENV = "preprod"
+	assert.Equal(t, preprod, Env())
+
+	// not matched, the default environment is selected regardless of priorities
+	BUILDENV = "unknown"
+	assert.Equal(t, Local, Env())
+
+	UnregisterEnvironment("sandbox")
+	UnregisterEnvironment("local")
+	assert.Equal(t, Local, Env())
+	assert.False(t, isEnvID("local"))
+
+	SetDefaultEnvironment(Development)
+	resolution := ResolveEnv()
+	assert.Equal(t, Development, resolution.Env)
+	assert.False(t, resolution.Matched)
+	assert.Equal(t, "'unknown', inferred from 'BUILDENV' var, not matched, default environment is 'development'.", resolution.String())
+
+	assert.Equal(t, []*Environment{Production, Staging, Testing, Development, preprod}, Environments())
+}
+
+func TestLoadEnvironments(t *testing.T) {
+	saveEnvironments(t)
+
+	writeConfigFile("environments.yml", `
+environments:
+  - id: qa
+    exps: [qa, release/qa-*]
+    runCompiled: true
+    priority: 45
+    parent: staging
+    attributes:
+      region: eu-west
+      replicas: {min: 1, max: 3}
+  - id: sandbox
+  - id: production
+    exps: [production, main]
+    attributes: {region: us-east}
+`, t)
+	writeConfigFile(".sprbox.json", `{"environments": [{"exps": ["missing-id"]}]}`, t)
+	defer removeConfigFiles(t)
+
+	if err := LoadEnvironments(filepath.Join(configPath, "environments.yml")); err != nil {
+		t.Fatal(err)
+	}
+
+	BUILDENV = "release/qa-1"
+	qa := Env()
+	assert.Equal(t, "qa", qa.ID())
+	assert.True(t, qa.RunCompiled)
+	assert.Equal(t, 45, qa.Priority)
+	assert.Equal(t, Staging, qa.Parent())
+	assert.Equal(t, "eu-west", qa.Attr("region"))
+	assert.Equal(t, map[string]interface{}{"min": 1, "max": 3}, qa.Attr("replicas"))
+
+	BUILDENV = "sandbox"
+	assert.Equal(t, "sandbox", Env().ID())
+	assert.Nil(t, Env().Parent())
+
+	BUILDENV = "main"
+	assert.Equal(t, Production, Env())
+	assert.True(t, Production.RunCompiled)
+	assert.Equal(t, "us-east", Production.Attr("region"))
+
+	assert.Error(t, LoadEnvironments(filepath.Join(configPath, ".sprbox.json")))
+	assert.Error(t, LoadEnvironments(filepath.Join(configPath, "missing.yml")))
+
+	// invalid expressions, nothing is registered
+	writeConfigFile("invalid.yml", `
+environments:
+  - id: preview
+  - id: demo
+    tagExps: ["v(1"]
+`, t)
+	err := LoadEnvironments(filepath.Join(configPath, "invalid.yml"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "environment 'demo'")
+	}
+	assert.Nil(t, lookupEnvironment("preview"))
+}
+
+func TestEnvResolvers(t *testing.T) {
+	saveEnvironments(t)
+
+	BUILDENV = ""
+	os.Unsetenv(EnvVarKey)
+	VCS = &Repository{BranchName: "release/1.0", HeadTags: []string{"production"}}
+
+	// go test in a git checkout selects the environment by branch
+	resolution := ResolveEnv()
+	assert.Equal(t, EnvResolution{Env: Staging, Tag: "release/1.0", Resolver: "git branch name", Matched: true}, resolution)
+	assert.Equal(t, "'release/1.0', inferred from git branch name.", resolution.String())
+	for _, resolver := range DefaultEnvResolvers() {
+		assert.NotEqual(t, TestingResolver().Name(), resolver.Name())
+	}
+
+	// unless TestingResolver is ahead of the git resolvers
+	SetEnvResolvers(append([]EnvResolver{TestingResolver()}, DefaultEnvResolvers()...)...)
+	assert.Equal(t, EnvResolution{Env: Testing, Tag: Testing.ID(), Resolver: "test flags", Matched: true}, ResolveEnv())
+	SetEnvResolvers(DefaultEnvResolvers()...)
+
+	// the testing resolvers are reachable when git is not available
+	VCS.Error = errors.New("not a git repository")
+	assert.Equal(t, "running file name", ResolveEnv().Resolver)
+	assert.Equal(t, Testing, Env())
+
+	writeConfigFile("sprbox.env", "development\n", t)
+	defer removeConfigFiles(t)
+
+	SetEnvResolvers(
+		MarkerFileResolver(filepath.Join(configPath, "missing.env")),
+		NewEnvResolver("custom", func() (string, bool) { return "", false }),
+		MarkerFileResolver(filepath.Join(configPath, "sprbox.env")),
+		TestingResolver(),
+	)
+	assert.Equal(t, Development, Env())
+	assert.Equal(t, "marker file '"+filepath.Join(configPath, "sprbox.env")+"'", ResolveEnv().Resolver)
+
+	VCS.Error = nil
+	SetEnvResolvers(GitTagResolver(), TestingResolver())
+	assert.Equal(t, Production, Env())
+
+	SetEnvResolvers(TestingResolver())
+	assert.Equal(t, Testing, Env())
+
+	SetEnvResolvers(EnvVarResolver("SPRBOX_TEST_UNKNOWN_ENV"))
+	os.Setenv("SPRBOX_TEST_UNKNOWN_ENV", "unknown")
+	defer os.Unsetenv("SPRBOX_TEST_UNKNOWN_ENV")
+	resolution = ResolveEnv()
+	assert.Equal(t, Local, resolution.Env)
+	assert.False(t, resolution.Matched)
+
+	SetEnvResolvers(HostnameResolver(), TestingResolver())
+	assert.Equal(t, Testing, Env())
+	hostname, _ := os.Hostname()
+	Development.AppendExp("^" + regexp.QuoteMeta(hostname) + "$")
+	assert.Equal(t, Development, Env())
+
+	SetEnvResolvers()
+	assert.Equal(t, EnvResolution{Env: Local}, ResolveEnv())
+}
+
+func TestGitTagEnv(t *testing.T) {
+	saveEnvironments(t)
+
+	BUILDENV = ""
+	os.Unsetenv(EnvVarKey)
+	VCS = &Repository{BranchName: "HEAD", Tag: "v1.3.0", HeadTags: []string{"stable", "v1.4.0-rc.1"}}
+
+	resolution := ResolveEnv()
+	assert.Equal(t, EnvResolution{Env: Staging, Tag: "v1.4.0-rc.1", Resolver: "git tag", Matched: true}, resolution)
+
+	VCS.HeadTags = []string{"v1.4.0"}
+	assert.Equal(t, Production, Env())
+
+	// no tags pointing at HEAD
+	VCS.HeadTags = []string{}
+	assert.Equal(t, "running file name", ResolveEnv().Resolver)
+
+	// Repository.Tag is the latest reachable tag, not necessarily pointing at HEAD
+	VCS.HeadTags = nil
+	assert.Equal(t, "running file name", ResolveEnv().Resolver)
+
+	assert.True(t, Staging.MatchTag("1.4.0-rc"))
+	assert.False(t, Production.MatchTag("v1.4.0-beta"))
+
+	Testing.SetTagExps([]string{`-beta(\.\d+)?$`})
+	VCS.HeadTags = []string{"v1.4.0-beta.2"}
+	assert.Equal(t, Testing, Env())
+}
+
+func TestKubernetesEnv(t *testing.T) {
+	saveEnvironments(t)
+	defer func(namespace, labels string) {
+		KubernetesNamespaceFile, KubernetesLabelsFile = namespace, labels
+	}(KubernetesNamespaceFile, KubernetesLabelsFile)
+
+	KubernetesNamespaceFile = filepath.Join(configPath, "namespace")
+	KubernetesLabelsFile = filepath.Join(configPath, "labels")
+	SetEnvResolvers(KubernetesResolver(), TestingResolver())
+
+	// not in a pod
+	assert.Equal(t, Testing, Env())
+
+	writeConfigFile("namespace", "shop-staging\n", t)
+	defer removeConfigFiles(t)
+
+	// the files are read once
+	assert.Equal(t, Testing, Env())
+
+	SetEnvResolvers(KubernetesResolver(), TestingResolver())
+	resolution := ResolveEnv()
+	assert.Equal(t, EnvResolution{Env: Staging, Tag: "staging", Resolver: "kubernetes pod", Matched: true}, resolution)
+
+	// labels take precedence over the namespace
+	writeConfigFile("labels", "app=\"shop\"\nenvironment=\"production\"\n", t)
+	SetEnvResolvers(KubernetesResolver(), TestingResolver())
+	assert.Equal(t, Production, Env())
+
+	SetEnvResolvers(KubernetesResolver("tier"), TestingResolver())
+	assert.Equal(t, Staging, Env())
+
+	// environment ids are matched exactly, not by their RegEx ('dev')
+	writeConfigFile("namespace", "payments-devops", t)
+	SetEnvResolvers(KubernetesResolver("tier"), TestingResolver())
+	assert.Equal(t, Testing, Env())
+
+	// not in the default chain
+	for _, resolver := range DefaultEnvResolvers() {
+		assert.NotEqual(t, "kubernetes pod", resolver.Name())
+	}
+
+	assert.Equal(t, map[string]string{"app": "shop", "environment": "production"}, kubernetesLabels(KubernetesLabelsFile))
+}
@@ -1,47 +1,439 @@
 package sprbox
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 )
 
 // files type regexp
 const extRegexp = `(?i)(.y(|a)ml|.toml|.json)` // `(?i)(\..{3,4})` //
 
+// supportedExtRegexp match the supported file extensions.
+var supportedExtRegexp = regexp.MustCompile(`^` + extRegexp + `$`)
+
+// ConfigPathEnvVarKey is the environment variable that
+// define the config search paths, separated by os.PathListSeparator
+// (eg.: SPRBOX_CONFIG_PATH=./config:$HOME/.config/app:/etc/app).
+const ConfigPathEnvVarKey = "SPRBOX_CONFIG_PATH"
+
+// ConfigSearchMode determine how the config search paths are used.
+type ConfigSearchMode int
+
+const (
+	// SearchFirstMatch use the files found in the
+	// first search path containing them (default).
+	SearchFirstMatch ConfigSearchMode = iota
+
+	// SearchLayered use the files found in all the search paths,
+	// the first search paths override the latest
+	// (eg.: ./config > $HOME/.config/app > /etc/app).
+	SearchLayered
+)
+
 // FILE SEARCH ---------------------------------------------------------------------------------------------------------
 
 // walkConfigPath look for a file matching the passed regex and skipping sub-directories.
-func walkConfigPath(configPath string, regex *regexp.Regexp) (matchedFile string) {
-	err := filepath.Walk(configPath, func(path string, info os.FileInfo, err error) error {
-		// nil if the path does not exist
-		if info == nil {
-			return filepath.SkipDir
+// If more than one file match (eg.: WP.yml and WP.json) the format precedence
+// is used to select one, an error is returned otherwise.
+func walkConfigPath(fsys fs.FS, configPath string, regex *regexp.Regexp) (matchedFile string, err error) {
+	entries, err := fs.ReadDir(fsys, configPath)
+	if err != nil {
+		// the path does not exist
+		if errors.Is(err, fs.ErrNotExist) {
+			err = nil
+		}
+		return "", err
+	}
+
+	var matchedFiles []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && regex.MatchString(entry.Name()) {
+			matchedFiles = append(matchedFiles, filepath.Join(configPath, entry.Name()))
+		}
+	}
+	return selectConfigFile(matchedFiles)
+}
+
+// selectConfigFile returns the only file in matchedFiles or,
+// if many, the one with the highest format precedence.
+func selectConfigFile(matchedFiles []string) (string, error) {
+	switch len(matchedFiles) {
+	case 0:
+		return "", nil
+	case 1:
+		return matchedFiles[0], nil
+	}
+
+	for _, format := range formatPrecedence {
+		format = "." + strings.TrimPrefix(format, ".")
+
+		var selected []string
+		for _, file := range matchedFiles {
+			if strings.EqualFold(filepath.Ext(file), format) {
+				selected = append(selected, file)
+			}
 		}
 
-		if info.IsDir() && info.Name() != filepath.Base(configPath) {
-			return filepath.SkipDir
+		if len(selected) == 1 {
+			return selected[0], nil
+		} else if len(selected) > 1 {
+			matchedFiles = selected
+			break
 		}
+	}
+
+	sort.Strings(matchedFiles)
+	return "", fmt.Errorf("ambiguous config files: %s, use SetFormatPrecedence() or remove the duplicates",
+		strings.Join(matchedFiles, ", "))
+}
+
+// searchPaths returns the config search paths, highest priority first.
+// Those set with SetConfigSearchPaths() have precedence
+// over the SPRBOX_CONFIG_PATH environment variable.
+func searchPaths() (paths []string) {
+	paths = configSearchPaths
+	if len(paths) == 0 {
+		paths = filepath.SplitList(os.Getenv(ConfigPathEnvVarKey))
+	}
+
+	var expanded []string
+	for _, path := range paths {
+		if path = os.ExpandEnv(path); len(path) > 0 {
+			expanded = append(expanded, path)
+		}
+	}
+	return expanded
+}
 
-		if !info.Mode().IsRegular() {
+// searchDirs returns the dirs where to look for the given path,
+// with the search paths in the same order as searchPaths().
+// Absolute paths are returned as is.
+//
+// The search paths only apply to the OS file system,
+// in any other fs.FS the path is returned as a valid fs.FS path, if possible.
+func searchDirs(fsys fs.FS, path string) []string {
+	if _, isOS := fsys.(osFS); !isOS {
+		if path = filepath.ToSlash(filepath.Clean(path)); !fs.ValidPath(path) {
 			return nil
 		}
+		return []string{path}
+	}
+
+	paths := searchPaths()
+	if len(paths) == 0 || filepath.IsAbs(path) {
+		return []string{path}
+	}
 
-		if regex.MatchString(info.Name()) {
-			matchedFile = path
+	dirs := make([]string, len(paths))
+	for i, searchPath := range paths {
+		dirs[i] = filepath.Join(searchPath, path)
+	}
+	return dirs
+}
+
+// searchConfigFiles returns all the eligible files
+// for the given files in the config search paths.
+//
+// In SearchFirstMatch mode only the files in the first
+// search path containing them are returned, in SearchLayered mode
+// the files in all the search paths are returned, lowest priority first.
+func searchConfigFiles(fsys fs.FS, files ...string) (foundFiles []string, err error) {
+	for _, file := range files {
+		dirs := searchDirs(fsys, file)
+
+		if configSearchMode == SearchLayered {
+			for i := len(dirs) - 1; i >= 0; i-- {
+				var found []string
+				if found, err = configFilesByEnv(fsys, dirs[i]); err != nil {
+					return nil, err
+				}
+				foundFiles = append(foundFiles, found...)
+			}
+			continue
 		}
 
-		return nil
-	})
+		for _, dir := range dirs {
+			var found []string
+			if found, err = configFilesByEnv(fsys, dir); err != nil {
+				return nil, err
+			} else if len(found) > 0 {
+				foundFiles = append(foundFiles, found...)
+				break
+			}
+		}
+	}
+	return
+}
 
+// isEnvID returns true if name is a registered environment id.
+func isEnvID(name string) bool {
+	for _, env := range Environments() {
+		if strings.EqualFold(name, env.ID()) {
+			return true
+		}
+	}
+	return false
+}
+
+// configFileBase returns the generic file of an environment-specific
+// or extra layer variant (eg.: tool.production.yml -> tool.yml,
+// production/tool.yml -> tool.yml, tool.development.local.yml -> tool.yml,
+// tool.<hostname>.yml -> tool.yml), configFilesByEnv will find the variants from there.
+func configFileBase(file string) string {
+	dir, name := filepath.Split(file)
+	ext := filepath.Ext(name)
+	noExt := strings.TrimSuffix(name, ext)
+
+	if layer := layerSuffix(noExt); len(layer) > 0 {
+		return configFileBase(filepath.Join(dir, strings.TrimSuffix(noExt, layer)+ext))
+	} else if variant := filepath.Ext(noExt); isEnvID(strings.TrimPrefix(variant, ".")) || variant == localSuffix {
+		return configFileBase(filepath.Join(dir, strings.TrimSuffix(noExt, variant)+ext))
+	} else if envDir := filepath.Dir(file); isEnvID(filepath.Base(envDir)) {
+		return filepath.Join(filepath.Dir(envDir), name)
+	}
+	return file
+}
+
+// layerSuffix returns the '.<layer>' suffix of name, if <layer>
+// is the name of an active extra layer, see SetConfigLayers().
+func layerSuffix(name string) string {
+	for _, resolver := range configLayers {
+		layer := resolver()
+		if len(layer) == 0 || len(name) <= len(layer)+1 {
+			continue
+		}
+		if suffix := name[len(name)-len(layer)-1:]; strings.EqualFold(suffix, "."+layer) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// isGlob returns true if path contains glob meta characters.
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// globRegexp convert a slash separated glob pattern to a regexp,
+// '**' match any number of directories,
+// '*' and '?' do not match the path separator.
+// If the pattern has no extension any supported extension is matched.
+func globRegexp(pattern string) (*regexp.Regexp, error) {
+	var exp strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**/") {
+				exp.WriteString("(.*/)?")
+				i += 2
+			} else if strings.HasPrefix(pattern[i:], "**") {
+				exp.WriteString(".*")
+				i++
+			} else {
+				exp.WriteString("[^/]*")
+			}
+		case '?':
+			exp.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid glob pattern: '%s'", pattern)
+			}
+			exp.WriteString(strings.Replace(pattern[i:i+end+1], "[!", "[^", 1))
+			i += end
+		default:
+			exp.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	format := "^%s%s$"
+	if !fileSearchCaseSensitive {
+		format = "(?i)^%s%s$"
+	}
+
+	ext := ""
+	if len(filepath.Ext(pattern)) == 0 || isGlob(filepath.Ext(pattern)) {
+		ext = extRegexp
+	}
+	return regexp.Compile(fmt.Sprintf(format, exp.String(), ext))
+}
+
+// configGlobFiles returns the config files matching the glob pattern
+// (eg.: MediaProcessing/*.yml, tenants/**/Services), in lexicographic order,
+// in any of the file systems in fss.
+// Environment-specific variants are returned as their generic file,
+// configFilesByEnv will find them.
+//
+// If config search paths are set the pattern is matched
+// in all of them, the returned files are relative and
+// will be resolved by searchConfigFiles.
+//
+// No error is returned if nothing matches.
+func configGlobFiles(fss []fs.FS, pattern string) (files []string, err error) {
+	// the static part of the pattern is the directory to walk
+	var root []string
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	for len(segments) > 1 && !isGlob(segments[0]) {
+		root = append(root, segments[0])
+		segments = segments[1:]
+	}
+	dir := filepath.FromSlash(strings.Join(root, "/"))
+	if len(root) == 1 && len(root[0]) == 0 {
+		dir = "/"
+	} else if len(dir) == 0 {
+		dir = "."
+	}
+
+	regex, err := globRegexp(strings.Join(segments, "/"))
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
 	}
+
+	found := make(map[string]bool)
+	for _, fsys := range fss {
+		for _, searchDir := range searchDirs(fsys, dir) {
+			if err = globDir(fsys, searchDir, dir, pattern, segments, regex, found); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for file := range found {
+		files = append(files, file)
+	}
+	sort.Strings(files)
 	return
 }
 
+// globDir add to found the files in searchDir matching the glob regex,
+// joined to dir.
+func globDir(fsys fs.FS, searchDir, dir, pattern string, segments []string, regex *regexp.Regexp, found map[string]bool) error {
+	return fs.WalkDir(fsys, searchDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(searchDir, path)
+		if err != nil {
+			return err
+		}
+
+		// without '**' do not walk deeper than the pattern (plus the env sub-directory)
+		if entry.IsDir() && rel != "." && !strings.Contains(pattern, "**") {
+			depth := len(strings.Split(filepath.ToSlash(rel), "/"))
+			if depth > len(segments) || (depth == len(segments) && !isEnvID(entry.Name())) {
+				return fs.SkipDir
+			}
+		}
+
+		if !entry.Type().IsRegular() || !supportedExtRegexp.MatchString(filepath.Ext(path)) {
+			return nil
+		}
+
+		if base := configFileBase(rel); regex.MatchString(filepath.ToSlash(rel)) ||
+			regex.MatchString(filepath.ToSlash(base)) {
+			found[filepath.Join(dir, base)] = true
+		}
+		return nil
+	})
+}
+
+// configDirFiles returns the config files in dir, in lexicographic order.
+// Environment-specific variants (eg.: <dir>/50-tuning.production.yml)
+// are returned as their generic file (<dir>/50-tuning.yml),
+// configFilesByEnv will find them.
+//
+// No error is returned if dir does not exist.
+func configDirFiles(dir string) ([]string, error) {
+	return configGlobFiles(configFSs(), filepath.Join(dir, "*"))
+}
+
+// LayerResolver returns the name of an extra config files layer
+// (eg.: the hostname for '<file>.<hostname>.yml'),
+// an empty name disable the layer.
+type LayerResolver func() string
+
+// HostnameLayer is the LayerResolver of the '<file>.<hostname>.*' layer.
+func HostnameLayer() string {
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+// EnvVarLayer returns a LayerResolver reading the layer
+// name from the given environment variable
+// (eg.: EnvVarLayer("REGION") for '<file>.<region>.*').
+func EnvVarLayer(key string) LayerResolver {
+	return func() string {
+		return os.Getenv(key)
+	}
+}
+
+// localSuffix is the suffix of the local override files,
+// they should not be tracked in the VCS (eg.: Services.local.yml).
+const localSuffix = ".local"
+
+// isLocalSuffix returns true if the environment id
+// is the local overrides suffix (the Local environment).
+func isLocalSuffix(envID string) bool {
+	return strings.EqualFold("."+envID, localSuffix)
+}
+
+// localOverridesWarned contains the local override
+// files already reported by warnLocalOverride.
+var localOverridesWarned = make(map[string]bool)
+
+// warnLocalOverride print a warning the first time
+// a local override file is used.
+func warnLocalOverride(file string) {
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	if !strings.HasSuffix(name, localSuffix) {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !localOverridesWarned[file] {
+		localOverridesWarned[file] = true
+		fmt.Printf("%s local override file in use: %s\n", yellow("WARNING:"), file)
+	}
+}
+
+// containsString returns true if list contains s.
+func containsString(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
+
+// FileSearchOrder is the search-order policy of
+// the environment-specific config files.
+type FileSearchOrder int
+
+const (
+	// EnvFileThenEnvDir layer '<path>/<environment>/<file>'
+	// after '<path>/<file>.<environment>' (default).
+	EnvFileThenEnvDir FileSearchOrder = iota
+
+	// EnvDirThenEnvFile layer '<path>/<file>.<environment>'
+	// after '<path>/<environment>/<file>'.
+	EnvDirThenEnvFile
+
+	// EnvFileOnly disable the environment subdirectory lookup.
+	EnvFileOnly
+)
+
 // configFilesByEnv will search for the given file in the given path
 // returning all the eligible files (eg.: <path>/myConfig.yaml and <path>/myConfig.<environment>.yaml)
 //
@@ -52,24 +444,43 @@ func walkConfigPath(configPath string, regex *regexp.Regexp) (matchedFile string
 // The 'file' name will be searched as (in that order):
 //  - '<path>/<file>(.* || <the_provided_extension>)'
 //  - '<path>/<file>.<environment>(.* || <the_provided_extension>)'
+//  - '<path>/<environment>/<file>(.* || <the_provided_extension>)'
+//
+// The order of the last two is determined by the FileSearchOrder,
+// see SetFileSearchOrder().
+// If the environment has a parent the parent files are searched first,
+// so that 'tool.preprod.yml' is layered over 'tool.production.yml'.
+//
+// Then the extra layers, if any, in the given order, see SetConfigLayers():
+//  - '<path>/<file>.<layer>(.* || <the_provided_extension>)'
+//
+// If the environment has LocalOverrides enabled,
+// the last layers will be:
+//  - '<path>/<file>.local(.* || <the_provided_extension>)'
+//  - '<path>/<file>.<environment>.local(.* || <the_provided_extension>)'
+//
+// In the Local environment '<file>.local' is only searched as a local override file.
 //
 // The latest found files will override previous.
-func configFilesByEnv(files ...string) (foundFiles []string) {
+//
+// The files are searched in fsys, use osFS{} for the OS file system.
+//
+// An error is returned if the same file is found in many formats
+// (eg.: WP.yml and WP.json) or, in case-insensitive search mode,
+// with different cases (eg.: wp.yml and WP.yml),
+// unless the format precedence select one of them, see SetFormatPrecedence().
+func configFilesByEnv(fsys fs.FS, files ...string) (foundFiles []string, err error) {
 	for _, file := range files {
 		configPath, fileName := filepath.Split(file)
-		if len(configPath) == 0 {
-			configPath = "./"
-		}
-
-		var regexEnv *regexp.Regexp
-		var regex *regexp.Regexp
+		configPath = filepath.Clean(configPath)
 
 		ext := filepath.Ext(fileName)
-		extTrimmed := strings.TrimSuffix(fileName, ext)
+		extTrimmed := regexp.QuoteMeta(strings.TrimSuffix(fileName, ext))
 		if len(ext) == 0 {
 			ext = extRegexp
 			debugPrintf(darkGrey("\nlooking for '%s%s' in '%s'..."), fileName, extRegexp, configPath)
 		} else {
+			ext = regexp.QuoteMeta(ext)
 			debugPrintf(darkGrey("\nlooking for '%s' in '%s'..."), fileName, configPath)
 		}
 
@@ -77,17 +488,80 @@ func configFilesByEnv(files ...string) (foundFiles []string) {
 		if !fileSearchCaseSensitive {
 			format = "(?i)(^%s)%s$"
 		}
-		regexEnv = regexp.MustCompile(fmt.Sprintf(format, fmt.Sprintf("%s.%s", extTrimmed, Env().ID()), ext))
-		regex = regexp.MustCompile(fmt.Sprintf(format, extTrimmed, ext))
+		regex := regexp.MustCompile(fmt.Sprintf(format, extTrimmed, ext))
 
 		// look for the config file in the config path (eg.: tool.yml)
-		if matchedFiles := walkConfigPath(configPath, regex); len(matchedFiles) > 0 {
-			foundFiles = append(foundFiles, matchedFiles)
+		var matchedFile string
+		if matchedFile, err = walkConfigPath(fsys, configPath, regex); err != nil {
+			return nil, err
+		} else if len(matchedFile) > 0 {
+			foundFiles = append(foundFiles, matchedFile)
+		}
+
+		// look for the env files along the parent chain, from the root environment
+		var envFiles []string
+		for _, env := range Env().Chain() {
+			// look for the env config file in the config path (eg.: tool.development.yml),
+			// in the Local environment tool.local.yml is the local override file, searched last
+			var envFile string
+			if !isLocalSuffix(env.ID()) {
+				regexEnv := regexp.MustCompile(fmt.Sprintf(format, fmt.Sprintf("%s.%s", extTrimmed, regexp.QuoteMeta(env.ID())), ext))
+				if envFile, err = walkConfigPath(fsys, configPath, regexEnv); err != nil {
+					return nil, err
+				}
+			}
+
+			// look for the config file in the env sub-directory (eg.: development/tool.yml)
+			var envDirFile string
+			if fileSearchOrder != EnvFileOnly {
+				if envDirFile, err = walkConfigPath(fsys, filepath.Join(configPath, env.ID()), regex); err != nil {
+					return nil, err
+				}
+			}
+
+			if fileSearchOrder == EnvDirThenEnvFile {
+				envFiles = append(envFiles, envDirFile, envFile)
+			} else {
+				envFiles = append(envFiles, envFile, envDirFile)
+			}
+		}
+
+		// look for the extra layers files (eg.: tool.<hostname>.yml)
+		for _, resolver := range configLayers {
+			layer := resolver()
+			if len(layer) == 0 {
+				continue
+			}
+
+			regexLayer := regexp.MustCompile(fmt.Sprintf(format, extTrimmed+regexp.QuoteMeta("."+layer), ext))
+			var layerFile string
+			if layerFile, err = walkConfigPath(fsys, configPath, regexLayer); err != nil {
+				return nil, err
+			}
+			envFiles = append(envFiles, layerFile)
+		}
+
+		// look for the local override files (eg.: tool.local.yml and tool.development.local.yml)
+		if env := Env(); env.LocalOverrides {
+			locals := []string{extTrimmed}
+			if !isLocalSuffix(env.ID()) {
+				locals = append(locals, fmt.Sprintf("%s.%s", extTrimmed, regexp.QuoteMeta(env.ID())))
+			}
+			for _, local := range locals {
+				regexLocal := regexp.MustCompile(fmt.Sprintf(format, local+regexp.QuoteMeta(localSuffix), ext))
+				var localFile string
+				if localFile, err = walkConfigPath(fsys, configPath, regexLocal); err != nil {
+					return nil, err
+				}
+				envFiles = append(envFiles, localFile)
+			}
 		}
 
-		// look for the env config file in the config path (eg.: tool.development.yml)
-		if matchedFiles := walkConfigPath(configPath, regexEnv); len(matchedFiles) > 0 {
-			foundFiles = append(foundFiles, matchedFiles)
+		for _, matchedFiles := range envFiles {
+			if len(matchedFiles) > 0 && !containsString(foundFiles, matchedFiles) {
+				foundFiles = append(foundFiles, matchedFiles)
+				warnLocalOverride(matchedFiles)
+			}
 		}
 	}
 
@@ -0,0 +1,299 @@
+package sprbox
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigFilesByEnvSubDir(t *testing.T) {
+	BUILDENV = Staging.ID()
+
+	writeConfigFile("Services.yml", "name: base", t)
+	writeConfigFile("Services.staging.yml", "name: staging", t)
+	writeConfigFile("staging/Services.yml", "name: staging-dir", t)
+	defer removeConfigFiles(t)
+	defer SetFileSearchOrder(EnvFileThenEnvDir)
+
+	base := filepath.Join(configPath, "Services.yml")
+	envFile := filepath.Join(configPath, "Services.staging.yml")
+	envDirFile := filepath.Join(configPath, "staging", "Services.yml")
+
+	files, err := configFilesByEnv(osFS{}, filepath.Join(configPath, "Services"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{base, envFile, envDirFile}, files)
+
+	var config LayeredConfig
+	if err := LoadConfig(&config, filepath.Join(configPath, "Services")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "staging-dir", config.Name)
+
+	SetFileSearchOrder(EnvDirThenEnvFile)
+	files, err = configFilesByEnv(osFS{}, filepath.Join(configPath, "Services.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{base, envDirFile, envFile}, files)
+
+	SetFileSearchOrder(EnvFileOnly)
+	files, err = configFilesByEnv(osFS{}, filepath.Join(configPath, "Services"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{base, envFile}, files)
+}
+
+func TestConfigSearchPaths(t *testing.T) {
+	BUILDENV = Staging.ID()
+
+	writeConfigFile("system/app/Tool1.yml", "path: system", t)
+	writeConfigFile("system/app/Services.yml", "name: system\nlog: {level: info, file: system.log}", t)
+	writeConfigFile("user/app/Services.yml", "log: {level: debug}", t)
+	writeConfigFile("user/app/Services.staging.yml", "name: user", t)
+	defer removeConfigFiles(t)
+	defer SetConfigSearchPaths()
+	defer SetConfigSearchMode(SearchFirstMatch)
+
+	SetConfigSearchPaths(filepath.Join(configPath, "local"), filepath.Join(configPath, "user"), filepath.Join(configPath, "system"))
+
+	var config LayeredConfig
+	if err := LoadConfig(&config, "app/Services"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "user", config.Name)
+	assert.Equal(t, LogConfig{Level: "debug"}, config.Log)
+
+	SetConfigSearchMode(SearchLayered)
+	config = LayeredConfig{}
+	if err := LoadConfig(&config, "app/Services"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "user", config.Name)
+	assert.Equal(t, LogConfig{Level: "debug", File: "system.log"}, config.Log)
+
+	var box struct{ Tool1 Tool }
+	if err := LoadToolBox(&box, "app"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "system", box.Tool1.Config.Path)
+
+	SetConfigSearchPaths()
+	os.Setenv(ConfigPathEnvVarKey, filepath.Join(configPath, "system")+string(os.PathListSeparator)+filepath.Join(configPath, "user"))
+	defer os.Unsetenv(ConfigPathEnvVarKey)
+
+	config = LayeredConfig{}
+	if err := LoadConfig(&config, "app/Services"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "system", config.Name)
+	assert.Equal(t, LogConfig{Level: "info", File: "system.log"}, config.Log)
+}
+
+func TestConfigGlobFiles(t *testing.T) {
+	writeConfigFile("MediaProcessing/Pictures.yml", "", t)
+	writeConfigFile("MediaProcessing/PicturesOverride.json", "", t)
+	writeConfigFile("MediaProcessing/Videos.production.toml", "", t)
+	writeConfigFile("MediaProcessing/staging/Audio.yml", "", t)
+	writeConfigFile("MediaProcessing/README.md", "", t)
+	writeConfigFile("MediaProcessing/sub/Pictures.yml", "", t)
+	writeConfigFile("tenants/a/Services.yml", "", t)
+	writeConfigFile("tenants/b/c/Services.development.yml", "", t)
+	writeConfigFile("tenants/b/Other.yml", "", t)
+	defer removeConfigFiles(t)
+
+	files, err := configGlobFiles(configFSs(), filepath.Join(configPath, "MediaProcessing/*"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(configPath, "MediaProcessing/Audio.yml"),
+		filepath.Join(configPath, "MediaProcessing/Pictures.yml"),
+		filepath.Join(configPath, "MediaProcessing/PicturesOverride.json"),
+		filepath.Join(configPath, "MediaProcessing/Videos.toml"),
+	}, files)
+
+	files, err = configGlobFiles(configFSs(), filepath.Join(configPath, "MediaProcessing/Pic?ures*.yml"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(configPath, "MediaProcessing/Pictures.yml")}, files)
+
+	files, err = configGlobFiles(configFSs(), filepath.Join(configPath, "tenants/**/Services"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(configPath, "tenants/a/Services.yml"),
+		filepath.Join(configPath, "tenants/b/c/Services.yml"),
+	}, files)
+
+	files, err = configGlobFiles(configFSs(), filepath.Join(configPath, "missing/*"))
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	_, err = configGlobFiles(configFSs(), filepath.Join(configPath, "MediaProcessing/[a-z"))
+	assert.Error(t, err)
+}
+
+func TestConfigFilesAmbiguity(t *testing.T) {
+	SetFileSearchCaseSensitive(true)
+
+	writeConfigFile("WP.yml", "name: yaml", t)
+	writeConfigFile("WP.json", `{"name": "json"}`, t)
+	writeConfigFile("wp.toml", `name = "toml"`, t)
+	defer removeConfigFiles(t)
+	defer SetFormatPrecedence()
+	defer SetFileSearchCaseSensitive(true)
+
+	var config LayeredConfig
+	err := LoadConfig(&config, filepath.Join(configPath, "WP"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "ambiguous config files: /tmp/sprbox/WP.json, /tmp/sprbox/WP.yml")
+	}
+
+	// an explicit extension is never ambiguous
+	assert.NoError(t, LoadConfig(&config, filepath.Join(configPath, "WP.yml")))
+	assert.Equal(t, "yaml", config.Name)
+
+	SetFormatPrecedence("toml", ".JSON", "yml")
+	config = LayeredConfig{}
+	assert.NoError(t, LoadConfig(&config, filepath.Join(configPath, "WP")))
+	assert.Equal(t, "json", config.Name)
+
+	SetFileSearchCaseSensitive(false)
+	config = LayeredConfig{}
+	assert.NoError(t, LoadConfig(&config, filepath.Join(configPath, "WP")))
+	assert.Equal(t, "toml", config.Name)
+
+	writeConfigFile("wp.json", `{"name": "json"}`, t)
+	err = LoadConfig(&config, filepath.Join(configPath, "WP.json"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "ambiguous config files: /tmp/sprbox/WP.json, /tmp/sprbox/wp.json")
+	}
+}
+
+func TestLocalOverrides(t *testing.T) {
+	writeConfigFile("Services.yml", "name: base", t)
+	writeConfigFile("Services.development.yml", "name: development", t)
+	writeConfigFile("Services.local.yml", "name: local\nlog: {level: debug}", t)
+	writeConfigFile("Services.development.local.json", `{"name": "development-local"}`, t)
+	defer removeConfigFiles(t)
+
+	base := filepath.Join(configPath, "Services.yml")
+	envFile := filepath.Join(configPath, "Services.development.yml")
+	local := filepath.Join(configPath, "Services.local.yml")
+	envLocal := filepath.Join(configPath, "Services.development.local.json")
+
+	BUILDENV = Development.ID()
+	files, err := configFilesByEnv(osFS{}, filepath.Join(configPath, "Services"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{base, envFile, local, envLocal}, files)
+
+	var config LayeredConfig
+	if err := LoadConfig(&config, filepath.Join(configPath, "Services")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "development-local", config.Name)
+	assert.Equal(t, "debug", config.Log.Level)
+
+	BUILDENV = Local.ID()
+	files, err = configFilesByEnv(osFS{}, filepath.Join(configPath, "Services"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{base, local}, files)
+
+	BUILDENV = Staging.ID()
+	files, err = configFilesByEnv(osFS{}, filepath.Join(configPath, "Services"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{base}, files)
+
+	// variants are returned as their generic file
+	files, err = configGlobFiles(configFSs(), filepath.Join(configPath, "*"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(configPath, "Services.json"), base}, files)
+}
+
+func TestConfigLayers(t *testing.T) {
+	BUILDENV = Staging.ID()
+
+	writeConfigFile("Services.yml", "name: base\nlog: {level: info}", t)
+	writeConfigFile("Services.staging.yml", "name: staging", t)
+	writeConfigFile("Services.eu-west.yml", "name: eu-west\nlog: {file: eu.log}", t)
+	writeConfigFile("Services.i-123.yml", "name: i-123", t)
+	defer removeConfigFiles(t)
+	defer SetConfigLayers()
+
+	os.Setenv("SPRBOX_TEST_REGION", "eu-west")
+	defer os.Unsetenv("SPRBOX_TEST_REGION")
+
+	SetConfigLayers(EnvVarLayer("SPRBOX_TEST_REGION"), func() string { return "i-123" }, EnvVarLayer("SPRBOX_TEST_MISSING"))
+
+	files, err := configFilesByEnv(osFS{}, filepath.Join(configPath, "Services"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(configPath, "Services.yml"),
+		filepath.Join(configPath, "Services.staging.yml"),
+		filepath.Join(configPath, "Services.eu-west.yml"),
+		filepath.Join(configPath, "Services.i-123.yml"),
+	}, files)
+
+	var config LayeredConfig
+	if err := LoadConfig(&config, filepath.Join(configPath, "Services")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "i-123", config.Name)
+	assert.Equal(t, LogConfig{Level: "info", File: "eu.log"}, config.Log)
+
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostname, HostnameLayer())
+
+	// layer variants are returned as their generic file
+	files, err = configGlobFiles(configFSs(), filepath.Join(configPath, "*"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(configPath, "Services.yml")}, files)
+
+	// the local override file is the last layer in the Local environment too
+	writeConfigFile("Services.local.yml", "name: local", t)
+	BUILDENV = Local.ID()
+	files, err = configFilesByEnv(osFS{}, filepath.Join(configPath, "Services"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(configPath, "Services.yml"),
+		filepath.Join(configPath, "Services.eu-west.yml"),
+		filepath.Join(configPath, "Services.i-123.yml"),
+		filepath.Join(configPath, "Services.local.yml"),
+	}, files)
+}
+
+func TestParentChainFiles(t *testing.T) {
+	saveEnvironments(t)
+
+	preprod := NewEnvironment("preprod", nil, true)
+	preprod.SetParent(Production.ID())
+	preprod.SetAttr("Debug", true)
+	Production.SetAttr("LogLevel", "warn")
+	RegisterEnvironment(preprod)
+
+	writeConfigFile("Services.yml", "name: base\nlog: {level: info}", t)
+	writeConfigFile("Services.production.yml", "name: production\nlog: {level: warn}", t)
+	writeConfigFile("Services.preprod.yml", "name: preprod", t)
+	defer removeConfigFiles(t)
+
+	BUILDENV = preprod.ID()
+	assert.Equal(t, []*Environment{Production, preprod}, Env().Chain())
+
+	files, err := configFilesByEnv(osFS{}, filepath.Join(configPath, "Services"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(configPath, "Services.yml"),
+		filepath.Join(configPath, "Services.production.yml"),
+		filepath.Join(configPath, "Services.preprod.yml"),
+	}, files)
+
+	var config LayeredConfig
+	if err := LoadConfig(&config, filepath.Join(configPath, "Services")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "preprod", config.Name)
+	assert.Equal(t, "warn", config.Log.Level)
+
+	assert.Equal(t, "warn", Env().Attr("LogLevel"))
+	assert.Equal(t, true, Env().Attr("Debug"))
+	assert.Nil(t, Production.Attr("Debug"))
+
+	// parent cycles
+	Production.SetParent(preprod.ID())
+	assert.Equal(t, []*Environment{Production, preprod}, preprod.Chain())
+}
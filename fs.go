@@ -0,0 +1,72 @@
+package sprbox
+
+import (
+	"io/fs"
+	"os"
+)
+
+// defaultConfigFS contains the default config files,
+// layered under the OS ones, see SetDefaultConfigFS().
+var defaultConfigFS fs.FS
+
+// toolBoxFS is the fs.FS passed to the 'configurableFS' interface
+// by LoadToolBox and LoadToolBoxFS, LoadConfigFS will search
+// the config files in the same file systems of the toolbox
+// and resolve the 'ref' template func against the toolbox.
+type toolBoxFS struct {
+	// FS is the highest priority file system.
+	fs.FS
+
+	// fss are the file systems in use, lowest priority first.
+	fss []fs.FS
+
+	// mounted is true in LoadToolBoxFS.
+	mounted bool
+
+	// refs resolve the 'ref' template func.
+	refs *refResolver
+}
+
+// newToolBoxFS returns the toolBoxFS of fsys,
+// or of the LoadConfig file systems if fsys is nil.
+func newToolBoxFS(fsys fs.FS) *toolBoxFS {
+	if fsys == nil {
+		fss := configFSs()
+		return &toolBoxFS{FS: fss[len(fss)-1], fss: fss}
+	}
+	return &toolBoxFS{FS: fsys, fss: []fs.FS{fsys}, mounted: true}
+}
+
+// osFS is the OS file system.
+// Unlike os.DirFS it has no root, names are OS paths,
+// either relative to the working directory or absolute.
+type osFS struct{}
+
+// Open implements fs.FS.
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(name)
+}
+
+// Stat implements fs.StatFS.
+func (osFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (osFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// ReadFile implements fs.ReadFileFS.
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+// configFSs returns the file systems used by LoadConfig,
+// lowest priority first.
+func configFSs() (fss []fs.FS) {
+	if defaultConfigFS != nil {
+		fss = append(fss, defaultConfigFS)
+	}
+	return append(fss, osFS{})
+}
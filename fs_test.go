@@ -0,0 +1,150 @@
+package sprbox
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testFS = fstest.MapFS{
+	"config/Services.yml":             {Data: []byte("name: embedded\nlog: {level: info, file: embedded.log}\n$include: [common/db.yml]")},
+	"config/Services.development.yml": {Data: []byte("log: {level: debug}")},
+	"config/common/db.yml":            {Data: []byte("db: {db: sprbox, user: embedded}")},
+	"config/Tool1.yml":                {Data: []byte("path: embedded")},
+	"config/Tool1.d/00-base.yml":      {Data: []byte("path: base")},
+}
+
+func TestLoadConfigFS(t *testing.T) {
+	BUILDENV = Development.ID()
+
+	var config LayeredConfig
+	if err := LoadConfigFS(testFS, &config, "./config/Services"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "embedded", config.Name)
+	assert.Equal(t, LogConfig{Level: "debug", File: "embedded.log"}, config.Log)
+	assert.Equal(t, DBConfig{DB: "sprbox", User: "embedded"}, config.DB)
+
+	files, err := configFilesByEnv(testFS, "config/Services")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"config/Services.yml", "config/Services.development.yml"}, files)
+
+	assert.Error(t, LoadConfigFS(testFS, &config, "/config/Services"), "invalid fs.FS path")
+	assert.Error(t, LoadConfigFS(testFS, &config, "config/Missing"))
+}
+
+// fsTool is a struct implementing the 'configurableFS' interface.
+type fsTool struct {
+	Config ToolConfig
+}
+
+// SpareConfigFS is the 'configurableFS' interface implementation.
+func (c *fsTool) SpareConfigFS(fsys fs.FS, config []string) error {
+	return LoadConfigFS(fsys, &c.Config, config...)
+}
+
+func TestLoadToolBoxFS(t *testing.T) {
+	var test struct {
+		Tool1 fsTool
+		Tool2 fsTool `sprbox:"dir=Tool1.d"`
+	}
+	if err := LoadToolBoxFS(testFS, &test, "config"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "embedded", test.Tool1.Config.Path)
+	assert.Equal(t, "base", test.Tool2.Config.Path)
+
+	// the 'configurable' interface can not load from the fs.FS
+	var box struct{ Tool1 Tool }
+	assert.Equal(t, errNotConfigurableFS, LoadToolBoxFS(testFS, &box, "config"))
+
+	// the 'configurableFS' interface is used in LoadToolBox too
+	writeConfigFile("Tool1.yml", "path: disk", t)
+	defer removeConfigFiles(t)
+	test.Tool1 = fsTool{}
+	if err := LoadToolBox(&test, configPath); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "disk", test.Tool1.Config.Path)
+}
+
+// nestedTool load config files from disk and a
+// nested toolbox in its 'configurableFS' implementation.
+type nestedTool struct {
+	Config ToolConfig
+	Disk   ToolConfig
+	Sub    struct{ Tool1 fsTool }
+}
+
+func (n *nestedTool) SpareConfigFS(fsys fs.FS, files []string) error {
+	if err := LoadConfigFS(fsys, &n.Config, files...); err != nil {
+		return err
+	}
+	if err := LoadConfig(&n.Disk, filepath.Join(configPath, "Tool1")); err != nil {
+		return err
+	}
+	return LoadToolBoxFS(fstest.MapFS{"Tool1.yml": {Data: []byte("path: nested")}}, &n.Sub, ".")
+}
+
+func TestNestedLoadToolBoxFS(t *testing.T) {
+	writeConfigFile("Tool1.yml", "path: disk", t)
+	defer removeConfigFiles(t)
+
+	var test struct {
+		Nested nestedTool `sprbox:"Tool1"`
+		Tool2  fsTool     `sprbox:"dir=Tool1.d"`
+	}
+	if err := LoadToolBoxFS(testFS, &test, "config"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "embedded", test.Nested.Config.Path)
+	assert.Equal(t, "disk", test.Nested.Disk.Path)
+	assert.Equal(t, "nested", test.Nested.Sub.Tool1.Config.Path)
+	assert.Equal(t, "base", test.Tool2.Config.Path)
+
+	// the file system is not in use outside of LoadToolBoxFS
+	var config ToolConfig
+	assert.NoError(t, LoadConfig(&config, filepath.Join(configPath, "Tool1")))
+	assert.Equal(t, "disk", config.Path)
+}
+
+func TestDefaultConfigFS(t *testing.T) {
+	BUILDENV = Development.ID()
+
+	writeConfigFile("Services.yml", "name: disk\ndb: {user: disk}", t)
+	defer removeConfigFiles(t)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(configPath); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	SetDefaultConfigFS(fstest.MapFS{
+		"Services.yml":  testFS["config/Services.yml"],
+		"common/db.yml": testFS["config/common/db.yml"],
+	})
+	defer SetDefaultConfigFS(nil)
+
+	var config LayeredConfig
+	if err := LoadConfig(&config, "Services"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "disk", config.Name)
+	assert.Equal(t, LogConfig{Level: "info", File: "embedded.log"}, config.Log)
+	assert.Equal(t, DBConfig{DB: "sprbox", User: "disk"}, config.DB)
+
+	// absolute paths are only searched on disk
+	config = LayeredConfig{}
+	if err := LoadConfig(&config, filepath.Join(configPath, "Services")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, LayeredConfig{Name: "disk", DB: DBConfig{User: "disk"}}, config)
+}
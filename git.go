@@ -4,14 +4,118 @@ import (
 	"errors"
 	"fmt"
 	"os/exec"
+	rtdebug "runtime/debug"
 	"strings"
 )
 
+// Git info embedded at build time with -ldflags, so that binaries
+// running without the .git directory (eg.: in a container) never exec git:
+//
+//	go build -ldflags "$(sprbox ldflags)" -o ./api_bin ./api
+//
+// or manually:
+//
+//	go build -ldflags "-X github.com/oblq/sprbox.GitBranch=$(git rev-parse --abbrev-ref HEAD) \
+//		-X github.com/oblq/sprbox.GitCommit=$(git rev-parse --short HEAD)" -o ./api_bin ./api
+//
+// GitHeadTags is a comma separated list of the tags pointing at HEAD.
+var (
+	GitBranch   = ""
+	GitCommit   = ""
+	GitTag      = ""
+	GitBuild    = ""
+	GitHeadTags = ""
+)
+
+// readBuildInfo returns the binary build info.
+var readBuildInfo = rtdebug.ReadBuildInfo
+
 // Repository represent a git repository
 type Repository struct {
 	Path                           string
 	BranchName, Commit, Build, Tag string
-	Error                          error
+
+	// HeadTags are the tags pointing at HEAD.
+	HeadTags []string
+
+	// Time is the commit time and Modified is true if the
+	// working tree had local changes, from the binary build info.
+	Time     string
+	Modified bool
+
+	// Embedded is true if the info has been embedded
+	// at build time with -ldflags, see EmbeddedRepository().
+	Embedded bool
+
+	Error error
+
+	// buildInfoCommit is true if Commit comes from the binary build info.
+	buildInfoCommit bool
+}
+
+// defaultRepository returns the info embedded with -ldflags if any,
+// the working directory repository otherwise, completed
+// with the binary build info.
+func defaultRepository() *Repository {
+	if repo := EmbeddedRepository(); repo != nil {
+		return repo
+	}
+
+	repo := &Repository{Path: "./"}
+	repo.setBuildInfo()
+	repo.UpdateInfo()
+	return repo
+}
+
+// EmbeddedRepository returns the git info embedded at build time
+// with -ldflags (see GitBranch and GitTag), completed with
+// the binary build info (runtime/debug.ReadBuildInfo():
+// vcs.revision, vcs.time and vcs.modified), the ldflags values take precedence.
+// It returns nil if GitBranch and GitTag are not set.
+func EmbeddedRepository() *Repository {
+	if len(GitBranch) == 0 && len(GitTag) == 0 {
+		return nil
+	}
+
+	repo := &Repository{
+		BranchName: GitBranch,
+		Commit:     GitCommit,
+		Tag:        GitTag,
+		Build:      GitBuild,
+		HeadTags:   []string{},
+		Embedded:   true,
+	}
+	if len(GitHeadTags) > 0 {
+		repo.HeadTags = strings.Split(GitHeadTags, ",")
+	}
+	repo.setBuildInfo()
+	return repo
+}
+
+// setBuildInfo set Time, Modified and, if empty, Commit
+// from the binary build info, git is not executed for them.
+func (r *Repository) setBuildInfo() {
+	info, ok := readBuildInfo()
+	if !ok {
+		return
+	}
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if len(r.Commit) == 0 {
+				r.Commit = setting.Value
+				if len(r.Commit) > 7 {
+					r.Commit = r.Commit[:7]
+				}
+				r.buildInfoCommit = true
+			}
+		case "vcs.time":
+			r.Time = setting.Value
+		case "vcs.modified":
+			r.Modified = setting.Value == "true"
+		}
+	}
 }
 
 // NewRepository return a new Repository instance for the given path
@@ -22,11 +126,24 @@ func NewRepository(path string) *Repository {
 }
 
 // UpdateInfo grab git info and set 'Error' var eventually.
+// The info embedded with -ldflags is never updated, git is not executed in that case,
+// nor for the commit if it comes from the binary build info.
 func (r *Repository) UpdateInfo() {
+	if r.Embedded {
+		return
+	}
+
 	r.BranchName = r.git("rev-parse", "--abbrev-ref", "HEAD")
-	r.Commit = r.git("rev-parse", "--short", "HEAD")
+	if !r.buildInfoCommit {
+		r.Commit = r.git("rev-parse", "--short", "HEAD")
+	}
 	r.Build = r.git("rev-list", "--all", "--count")
 	r.Tag = r.git("describe", "--abbrev=0", "--tags", "--always")
+
+	r.HeadTags = []string{}
+	if tags := r.git("tag", "--points-at", "HEAD"); r.Error == nil && len(tags) > 0 {
+		r.HeadTags = strings.Split(tags, "\n")
+	}
 }
 
 // Git is the bash git command.
@@ -55,7 +172,11 @@ func (r *Repository) git(params ...string) string {
 
 // Info return Git repository info.
 func (r *Repository) Info() string {
-	return fmt.Sprintf("Git Branch: %s\nGit Commit: %s\nGit Tag: %s\nGit Build: %s\n", r.BranchName, r.Commit, r.Tag, r.Build)
+	info := fmt.Sprintf("Git Branch: %s\nGit Commit: %s\nGit Tag: %s\nGit Build: %s\n", r.BranchName, r.Commit, r.Tag, r.Build)
+	if len(r.Time) > 0 {
+		info += fmt.Sprintf("Git Time: %s\nGit Modified: %v\n", r.Time, r.Modified)
+	}
+	return info
 }
 
 // PrintInfo print git data in console.
@@ -69,5 +190,23 @@ func (r *Repository) PrintInfo() {
 	gitLog.Println("Git Commit:", r.Commit)
 	gitLog.Println("Git Tag:", r.Tag)
 	gitLog.Println("Git Build:", r.Build)
+	if len(r.Time) > 0 {
+		gitLog.Println("Git Time:", r.Time)
+		gitLog.Println("Git Modified:", r.Modified)
+	}
 	fmt.Println("")
 }
+
+// sprboxVersion returns the sprbox module version from the binary build info.
+func sprboxVersion() string {
+	info, ok := readBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, module := range append([]*rtdebug.Module{&info.Main}, info.Deps...) {
+		if module.Path == "github.com/oblq/sprbox" && module.Version != "(devel)" {
+			return module.Version
+		}
+	}
+	return ""
+}
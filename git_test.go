@@ -1,6 +1,8 @@
 package sprbox
 
 import (
+	"os"
+	rtdebug "runtime/debug"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,3 +18,59 @@ func TestNewRepository(t *testing.T) {
 func TestNewWrongRepository(t *testing.T) {
 	assert.Error(t, NewRepository("../").Error)
 }
+
+func TestEmbeddedRepository(t *testing.T) {
+	saveEnvironments(t)
+	defer func(info func() (*rtdebug.BuildInfo, bool)) { readBuildInfo = info }(readBuildInfo)
+	readBuildInfo = func() (*rtdebug.BuildInfo, bool) { return nil, false }
+
+	assert.Nil(t, EmbeddedRepository())
+
+	readBuildInfo = func() (*rtdebug.BuildInfo, bool) {
+		return &rtdebug.BuildInfo{Settings: []rtdebug.BuildSetting{
+			{Key: "vcs", Value: "git"},
+			{Key: "vcs.revision", Value: "0123456789abcdef"},
+			{Key: "vcs.time", Value: "2026-10-18T10:00:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		}}, true
+	}
+	// the build info alone is not embedded, git is executed for the missing fields
+	assert.Nil(t, EmbeddedRepository())
+	repo := defaultRepository()
+	assert.False(t, repo.Embedded)
+	assert.NoError(t, repo.Error)
+	assert.Equal(t, NewRepository("./").BranchName, repo.BranchName)
+	assert.Equal(t, "0123456", repo.Commit)
+	assert.Equal(t, "2026-10-18T10:00:00Z", repo.Time)
+	assert.True(t, repo.Modified)
+	assert.Contains(t, repo.Info(), "Git Modified: true")
+
+	repo.UpdateInfo()
+	assert.Equal(t, "0123456", repo.Commit)
+
+	GitBranch, GitCommit, GitTag, GitBuild, GitHeadTags = "HEAD", "fedcba9", "v1.4.0", "42", "v1.4.0,stable"
+	defer func() { GitBranch, GitCommit, GitTag, GitBuild, GitHeadTags = "", "", "", "", "" }()
+	repo = EmbeddedRepository()
+	assert.Equal(t, &Repository{
+		BranchName: "HEAD", Commit: "fedcba9", Tag: "v1.4.0", Build: "42",
+		HeadTags: []string{"v1.4.0", "stable"},
+		Time:     "2026-10-18T10:00:00Z", Modified: true, Embedded: true,
+	}, repo)
+
+	// git is never executed for the embedded info
+	repo.UpdateInfo()
+	assert.Equal(t, "fedcba9", repo.Commit)
+	assert.NoError(t, repo.Error)
+
+	VCS = defaultRepository()
+	BUILDENV = ""
+	os.Unsetenv(EnvVarKey)
+	assert.Equal(t, Production, Env())
+
+	// a detached HEAD after a tag, no tags pointing at HEAD
+	GitTag, GitHeadTags = "v1.0.0", ""
+	VCS = defaultRepository()
+	assert.Equal(t, []string{}, VCS.HeadTags)
+	assert.NotEqual(t, "git tag", ResolveEnv().Resolver)
+	assert.NotEqual(t, Production, Env())
+}
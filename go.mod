@@ -1,6 +1,6 @@
 module github.com/oblq/sprbox
 
-go 1.12
+go 1.18
 
 require (
 	github.com/BurntSushi/toml v0.3.1
@@ -8,3 +8,8 @@ require (
 	github.com/stretchr/testify v1.3.0
 	gopkg.in/yaml.v2 v2.2.2
 )
+
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+)
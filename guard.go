@@ -0,0 +1,144 @@
+package sprbox
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isGoRun returns true if the program has been launched with `go run`
+// (the executable is built in a temporary 'go-build' directory).
+var isGoRun = func() bool {
+	exe, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(exe, string(filepath.Separator)+"go-build")
+}
+
+// RequireEnv returns an error if the current environment is not one of envs,
+// or if no environment matched the resolved tag
+// (the default environment is silently selected in that case).
+//
+//	if err := sprbox.RequireEnv(sprbox.Production, sprbox.Staging); err != nil {
+//		log.Fatal(err)
+//	}
+func RequireEnv(envs ...*Environment) error {
+	resolution := ResolveEnv()
+	if !resolution.Matched {
+		return fmt.Errorf("environment: no environment matched the tag %s", resolution)
+	}
+
+	ids := make([]string, 0, len(envs))
+	for _, env := range envs {
+		if env == resolution.Env {
+			return nil
+		}
+		ids = append(ids, env.ID())
+	}
+	return fmt.Errorf("environment: '%s' is not allowed (%s), tag %s",
+		resolution.Env.ID(), strings.Join(ids, ", "), resolution)
+}
+
+// CheckEnv is a startup check returning an error if:
+//   - the BUILDENV var and the BUILD_ENV environment variable select different environments,
+//   - a RunCompiled environment is running with `go run`,
+//   - Production is selected while '.local' or development-only config files
+//     (eg.: 'tool.development.yml' or 'development/tool.yml') are present in configPaths.
+//
+// All the problems found are returned.
+func CheckEnv(configPaths ...string) error {
+	var errs []string
+
+	env := Env()
+
+	if len(BUILDENV) > 0 {
+		if envVar := os.Getenv(EnvVarKey); len(envVar) > 0 {
+			if compiled, runtime := matchEnvironment(BUILDENV), matchEnvironment(envVar); compiled != runtime {
+				errs = append(errs, fmt.Sprintf("environment: the BUILDENV var ('%s') and the %s environment variable ('%s') mismatch",
+					BUILDENV, EnvVarKey, envVar))
+			}
+		}
+	}
+
+	if env.RunCompiled && isGoRun() {
+		errs = append(errs, fmt.Sprintf("environment: '%s' should run compiled, not with `go run`", env.ID()))
+	}
+
+	if env == Production {
+		for _, configPath := range configPaths {
+			files, err := devConfigFiles(configPath)
+			if err != nil {
+				errs = append(errs, err.Error())
+			} else if len(files) > 0 {
+				errs = append(errs, fmt.Sprintf("environment: '%s' with development config files: %s",
+					env.ID(), strings.Join(files, ", ")))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "\n"))
+	}
+	return nil
+}
+
+// matchEnvironment returns the first environment matching tag, if any.
+func matchEnvironment(tag string) *Environment {
+	for _, env := range Environments() {
+		if env.MatchTag(tag) {
+			return env
+		}
+	}
+	return nil
+}
+
+// devConfigFiles returns the '.local' config files and the config files of the
+// environments with LocalOverrides (development and local by default) in dir.
+func devConfigFiles(dir string) (files []string, err error) {
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return nil
+			}
+			return err
+		}
+
+		if entry.IsDir() {
+			if path != dir && isDevEnvID(entry.Name()) {
+				files = append(files, path)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		ext := filepath.Ext(path)
+		if !supportedExtRegexp.MatchString(ext) {
+			return nil
+		}
+
+		variants := strings.Split(strings.TrimSuffix(entry.Name(), ext), ".")
+		for _, variant := range variants[1:] {
+			if "."+variant == localSuffix || isDevEnvID(variant) {
+				files = append(files, path)
+				break
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// isDevEnvID returns true if name is the id
+// of an environment with LocalOverrides.
+func isDevEnvID(name string) bool {
+	for _, env := range Environments() {
+		if env.LocalOverrides && strings.EqualFold(name, env.ID()) {
+			return true
+		}
+	}
+	return false
+}
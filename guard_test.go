@@ -0,0 +1,83 @@
+package sprbox
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequireEnv(t *testing.T) {
+	saveEnvironments(t)
+	os.Unsetenv(EnvVarKey)
+
+	BUILDENV = "release/1.0"
+	assert.NoError(t, RequireEnv(Production, Staging))
+
+	BUILDENV = Development.ID()
+	err := RequireEnv(Production, Staging)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "'development' is not allowed (production, staging)")
+	}
+
+	// silent fallback to the default environment
+	BUILDENV = "unknown"
+	assert.Equal(t, Local, Env())
+	err = RequireEnv(Local)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no environment matched the tag 'unknown'")
+	}
+}
+
+func TestCheckEnv(t *testing.T) {
+	saveEnvironments(t)
+	defer func(goRun func() bool) { isGoRun = goRun }(isGoRun)
+	isGoRun = func() bool { return false }
+	os.Unsetenv(EnvVarKey)
+
+	writeConfigFile("config/Services.yml", "", t)
+	writeConfigFile("config/Services.production.yml", "", t)
+	writeConfigFile("config/README.md", "", t)
+	defer removeConfigFiles(t)
+
+	config := filepath.Join(configPath, "config")
+
+	BUILDENV = Production.ID()
+	assert.NoError(t, CheckEnv(config, filepath.Join(configPath, "missing")))
+
+	// compiled and runtime environment mismatch
+	os.Setenv(EnvVarKey, "master")
+	assert.NoError(t, CheckEnv())
+	os.Setenv(EnvVarKey, Staging.ID())
+	err := CheckEnv()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "the BUILDENV var ('production') and the BUILD_ENV environment variable ('staging') mismatch")
+	}
+	os.Unsetenv(EnvVarKey)
+
+	// RunCompiled environment with `go run`
+	isGoRun = func() bool { return true }
+	err = CheckEnv()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "'production' should run compiled")
+	}
+	BUILDENV = Development.ID()
+	assert.NoError(t, CheckEnv())
+	isGoRun = func() bool { return false }
+
+	// development config files in production
+	writeConfigFile("config/Services.local.yml", "", t)
+	writeConfigFile("config/Tool.development.json", "", t)
+	writeConfigFile("config/local/Tool.yml", "", t)
+	assert.NoError(t, CheckEnv(config))
+
+	BUILDENV = Production.ID()
+	err = CheckEnv(config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), filepath.Join(config, "Services.local.yml"))
+		assert.Contains(t, err.Error(), filepath.Join(config, "Tool.development.json"))
+		assert.Contains(t, err.Error(), filepath.Join(config, "local"))
+		assert.NotContains(t, err.Error(), "Services.production.yml")
+	}
+}
@@ -0,0 +1,466 @@
+package sprbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// includeKey is the key used to include other config files,
+	// in any format: `$include: ["common/db.yml"]`.
+	includeKey = "$include"
+
+	// extendsKey is the top-level key used to inherit
+	// from a parent config file: `$extends: ../base/Services.yml`.
+	extendsKey = "$extends"
+
+	// envSelectorKey is the top-level key used to select the
+	// environments a YAML document apply to: `sprbox.env: staging`.
+	// The value is a regular expression (or a list of) matched against Env().ID().
+	envSelectorKey = "sprbox.env"
+
+	// sectionedKey and sectionedValue are the top-level marker of
+	// the sectioned config files: `sprbox: sectioned`.
+	sectionedKey   = "sprbox"
+	sectionedValue = "sectioned"
+
+	// defaultSection is the section applied to every environment
+	// in sectioned config files.
+	defaultSection = "default"
+)
+
+var (
+	// includeTagRegexp match the YAML include tag: `db: !include common/db.yml`.
+	includeTagRegexp = regexp.MustCompile(`!include\s+("[^"]*"|'[^']*'|[^\s#,\]}]+)`)
+
+	// yamlDocSeparatorRegexp match the YAML documents separator.
+	yamlDocSeparatorRegexp = regexp.MustCompile(`(?m)^---[ \t]*(#.*)?$`)
+)
+
+// configLayer is a single piece of configuration data,
+// LoadConfig unmarshal every layer on top of the previous ones.
+type configLayer struct {
+	// file is the source file, its extension determine the data format.
+	file string
+	data []byte
+}
+
+// marshalerFor returns the marshal func for the given file extension.
+func marshalerFor(file string) (func(interface{}) ([]byte, error), error) {
+	ext := filepath.Ext(file)
+
+	switch {
+	case regexp.MustCompile(regexYAML).MatchString(ext):
+		return yaml.Marshal, nil
+	case regexp.MustCompile(regexTOML).MatchString(ext):
+		return func(v interface{}) ([]byte, error) {
+			var buf bytes.Buffer
+			err := toml.NewEncoder(&buf).Encode(v)
+			return buf.Bytes(), err
+		}, nil
+	case regexp.MustCompile(regexJSON).MatchString(ext):
+		return json.Marshal, nil
+	default:
+		return nil, fmt.Errorf("unknown data format, can't marshal file: '%s'", file)
+	}
+}
+
+// fileLayers returns the layers of the given config file,
+// included and extended files are merged in the file data.
+//
+// Every document in a multi-document YAML file is a separate layer,
+// documents with an environment selector are skipped
+// if the selector does not match the current environment.
+// If sectioned every document is divided in environment sections.
+func fileLayers(fsys fs.FS, file string, sectioned bool) ([]configLayer, error) {
+	data, err := fs.ReadFile(fsys, file)
+	if err != nil {
+		return nil, err
+	}
+
+	docs := [][]byte{data}
+	if regexp.MustCompile(regexYAML).MatchString(filepath.Ext(file)) && yamlDocSeparatorRegexp.Match(data) {
+		docs = nil
+		for _, doc := range yamlDocSeparatorRegexp.Split(string(data), -1) {
+			if len(strings.TrimSpace(doc)) > 0 {
+				docs = append(docs, []byte(doc))
+			}
+		}
+	}
+
+	var layers []configLayer
+	for _, doc := range docs {
+		layer, selected, err := documentLayer(fsys, file, doc, sectioned)
+		if err != nil {
+			return nil, err
+		} else if selected {
+			layers = append(layers, layer)
+		}
+	}
+	return layers, nil
+}
+
+// documentLayer returns the layer for a single config document,
+// selected is false if the document does not apply to the current environment.
+//
+// Sectioned documents are replaced by their `default`
+// section merged with the current environment one,
+// an error is returned if neither is found.
+func documentLayer(fsys fs.FS, file string, data []byte, sectioned bool) (layer configLayer, selected bool, err error) {
+	layer = configLayer{file: file, data: data}
+
+	if !sectioned &&
+		!bytes.Contains(data, []byte(includeKey[1:])) &&
+		!bytes.Contains(data, []byte(extendsKey)) &&
+		!bytes.Contains(data, []byte(envSelectorKey)) &&
+		!bytes.Contains(data, []byte(sectionedValue)) {
+		return layer, true, nil
+	}
+
+	var value interface{}
+	if value, err = decodeGeneric(file, data); err != nil {
+		// let LoadConfig return the unmarshal error.
+		return layer, true, nil
+	}
+
+	if m, isMap := value.(map[string]interface{}); isMap {
+		changed := false
+
+		if selector, found := m[envSelectorKey]; found {
+			if selected, err = matchEnvSelector(selector); err != nil || !selected {
+				return layer, false, err
+			}
+			delete(m, envSelectorKey)
+			changed = true
+		}
+
+		if sectioned || m[sectionedKey] == sectionedValue {
+			envID := Env().ID()
+			defaultValue, defaultFound := m[defaultSection]
+			section, sectionFound := m[envID]
+			if !defaultFound && !sectionFound {
+				return layer, false, fmt.Errorf("%s: sectioned config without the '%s' or '%s' section",
+					file, defaultSection, envID)
+			}
+
+			value = defaultValue
+			if sectionFound {
+				value = deepMerge(value, section)
+			}
+			if value == nil {
+				return layer, false, nil
+			}
+			changed = true
+		}
+
+		if !changed && !hasIncludes(value) && !hasExtends(value) {
+			return layer, true, nil
+		}
+	} else if !hasIncludes(value) {
+		return layer, true, nil
+	}
+
+	if value, err = expandDirectives(fsys, value, file, []string{file}); err != nil {
+		return layer, false, err
+	}
+
+	if layer.data, err = encodeGeneric(file, value); err != nil {
+		return layer, false, err
+	}
+	return layer, true, nil
+}
+
+// matchEnvSelector match the environment selector value against Env().ID().
+func matchEnvSelector(selector interface{}) (bool, error) {
+	var exps []string
+	switch s := selector.(type) {
+	case string:
+		exps = []string{s}
+	case []interface{}:
+		for _, exp := range s {
+			exps = append(exps, fmt.Sprint(exp))
+		}
+	default:
+		return false, fmt.Errorf("invalid %s value: %v", envSelectorKey, selector)
+	}
+
+	envID := Env().ID()
+	for _, exp := range exps {
+		regex, err := regexp.Compile("^(" + exp + ")$")
+		if err != nil {
+			return false, fmt.Errorf("invalid %s value: %v", envSelectorKey, err)
+		}
+		if regex.MatchString(envID) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// decodeGeneric unmarshal data in a generic, normalized, interface.
+// YAML include tags are converted to include keys.
+func decodeGeneric(file string, data []byte) (interface{}, error) {
+	unmarshal, err := unmarshalerFor(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if regexp.MustCompile(regexYAML).MatchString(filepath.Ext(file)) {
+		data = includeTagRegexp.ReplaceAll(data, []byte(`{"$`+includeKey+`": [${1}]}`))
+	}
+
+	var value interface{}
+	if err = unmarshal(data, &value, file); err != nil {
+		return nil, err
+	}
+	return normalize(value), nil
+}
+
+// encodeGeneric marshal the value in the file format.
+func encodeGeneric(file string, value interface{}) ([]byte, error) {
+	marshal, err := marshalerFor(file)
+	if err != nil {
+		return nil, err
+	}
+	return marshal(value)
+}
+
+// normalize convert YAML maps (map[interface{}]interface{})
+// to map[string]interface{}, recursively.
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			m[fmt.Sprint(key)] = normalize(elem)
+		}
+		return m
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = normalize(elem)
+		}
+		return v
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = normalize(elem)
+		}
+		return v
+	case []map[string]interface{}:
+		// TOML array of tables
+		s := make([]interface{}, len(v))
+		for i, elem := range v {
+			s[i] = normalize(elem)
+		}
+		return s
+	default:
+		return value
+	}
+}
+
+// deepMerge merge src over dst, maps are merged recursively,
+// any other src value override the dst one.
+func deepMerge(dst, src interface{}) interface{} {
+	dstMap, dstIsMap := dst.(map[string]interface{})
+	srcMap, srcIsMap := src.(map[string]interface{})
+	if !dstIsMap || !srcIsMap {
+		return src
+	}
+
+	merged := make(map[string]interface{}, len(dstMap)+len(srcMap))
+	for key, elem := range dstMap {
+		merged[key] = elem
+	}
+	for key, elem := range srcMap {
+		if dstElem, found := merged[key]; found {
+			merged[key] = deepMerge(dstElem, elem)
+		} else {
+			merged[key] = elem
+		}
+	}
+	return merged
+}
+
+func hasExtends(value interface{}) bool {
+	if m, isMap := value.(map[string]interface{}); isMap {
+		_, found := m[extendsKey]
+		return found
+	}
+	return false
+}
+
+func hasIncludes(value interface{}) bool {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if _, found := v[includeKey]; found {
+			return true
+		}
+		for _, elem := range v {
+			if hasIncludes(elem) {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, elem := range v {
+			if hasIncludes(elem) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expandDirectives resolve the extends and include directives in the file value.
+// The file value is deep-merged over its parent one.
+func expandDirectives(fsys fs.FS, value interface{}, file string, stack []string) (interface{}, error) {
+	var parent interface{}
+	if hasExtends(value) {
+		m := value.(map[string]interface{})
+
+		extends, isString := m[extendsKey].(string)
+		if !isString {
+			return nil, fmt.Errorf("invalid %s value in '%s': %v", extendsKey, file, m[extendsKey])
+		}
+		delete(m, extendsKey)
+
+		var err error
+		if parent, err = loadGenericFiles(fsys, extendsKey, extends, filepath.Dir(file), stack); err != nil {
+			return nil, err
+		}
+	}
+
+	value, err := expandIncludes(fsys, value, filepath.Dir(file), stack)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent != nil {
+		value = deepMerge(parent, value)
+	}
+	return value, nil
+}
+
+// expandIncludes replace the include keys with the included files content.
+// The including map keys override the included files values,
+// a map containing only the include key is replaced by the included content.
+//
+// Include paths are relative to the including file dir and
+// they are searched with their environment-specific variants.
+func expandIncludes(fsys fs.FS, value interface{}, dir string, stack []string) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		var included interface{}
+		if paths, found := v[includeKey]; found {
+			var err error
+			if included, err = includeFiles(fsys, paths, dir, stack); err != nil {
+				return nil, err
+			}
+		}
+
+		m := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			if key == includeKey {
+				continue
+			}
+			expanded, err := expandIncludes(fsys, elem, dir, stack)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = expanded
+		}
+
+		if included == nil {
+			return m, nil
+		} else if len(m) == 0 {
+			return included, nil
+		}
+		return deepMerge(included, m), nil
+
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, elem := range v {
+			expanded, err := expandIncludes(fsys, elem, dir, stack)
+			if err != nil {
+				return nil, err
+			}
+			s[i] = expanded
+		}
+		return s, nil
+
+	default:
+		return value, nil
+	}
+}
+
+// includeFiles returns the merged content of the given include paths.
+func includeFiles(fsys fs.FS, paths interface{}, dir string, stack []string) (merged interface{}, err error) {
+	var includes []string
+	switch p := paths.(type) {
+	case string:
+		includes = []string{p}
+	case []interface{}:
+		for _, include := range p {
+			includes = append(includes, fmt.Sprint(include))
+		}
+	default:
+		return nil, fmt.Errorf("invalid %s value: %v", includeKey, paths)
+	}
+
+	for _, include := range includes {
+		var value interface{}
+		if value, err = loadGenericFiles(fsys, "include", include, dir, stack); err != nil {
+			return nil, err
+		}
+		merged = deepMerge(merged, value)
+	}
+	return
+}
+
+// loadGenericFiles returns the merged content of the config file
+// at path (relative to dir) and its environment-specific variants.
+// Directives in the loaded files are resolved recursively.
+func loadGenericFiles(fsys fs.FS, directive string, path string, dir string, stack []string) (merged interface{}, err error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	files, err := configFilesByEnv(fsys, path)
+	if err != nil {
+		return nil, err
+	} else if len(files) == 0 {
+		return nil, fmt.Errorf("no config file found for %s '%s' in '%s'", directive, path, stack[len(stack)-1])
+	}
+
+	for _, file := range files {
+		for i, loading := range stack {
+			if filepath.Clean(loading) == filepath.Clean(file) {
+				cycle := append(append([]string{}, stack[i:]...), file)
+				return nil, fmt.Errorf("%s cycle: %s", directive, strings.Join(cycle, " -> "))
+			}
+		}
+
+		var data []byte
+		if data, err = fs.ReadFile(fsys, file); err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		if value, err = decodeGeneric(file, data); err != nil {
+			return nil, fmt.Errorf("can't %s '%s': %v", directive, file, err)
+		}
+
+		if value, err = expandDirectives(fsys, value, file, append(stack, file)); err != nil {
+			return nil, err
+		}
+
+		merged = deepMerge(merged, value)
+	}
+	return
+}
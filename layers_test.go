@@ -0,0 +1,261 @@
+package sprbox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfigFile write a single config file, without environment variants.
+func writeConfigFile(fileName string, data string, t *testing.T) {
+	filePath := filepath.Join(configPath, fileName)
+
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		t.Error(err)
+	}
+
+	if err := ioutil.WriteFile(filePath, []byte(data), os.ModePerm); err != nil {
+		t.Errorf("failed to create config file: %v", err)
+	}
+}
+
+type LayeredConfig struct {
+	Name    string
+	Log     LogConfig
+	DB      DBConfig
+	Servers []LogConfig
+}
+
+type DBConfig struct {
+	DB       string
+	User     string
+	Password string
+}
+
+type LogConfig struct {
+	Level string
+	File  string
+}
+
+func TestIncludes(t *testing.T) {
+	BUILDENV = Development.ID()
+
+	writeConfigFile("common/log.yml", "level: info\nfile: /var/log/sprbox.log", t)
+	writeConfigFile("common/log.development.yml", "level: debug", t)
+	writeConfigFile("common/db.json", `{"db": {"db": "sprbox", "user": "me", "password": "secret"}}`, t)
+	writeConfigFile("config.yml", `
+$include: ["common/db.json"]
+name: sprbox
+log: !include common/log.yml
+servers:
+  - !include common/log.yml
+  - {$include: "common/log.yml", level: warning}
+db:
+  user: overridden
+`, t)
+	defer removeConfigFiles(t)
+
+	var config LayeredConfig
+	if err := LoadConfig(&config, filepath.Join(configPath, "config.yml")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "sprbox", config.Name)
+	assert.Equal(t, LogConfig{Level: "debug", File: "/var/log/sprbox.log"}, config.Log)
+	assert.Equal(t, "sprbox", config.DB.DB)
+	assert.Equal(t, "overridden", config.DB.User)
+	assert.Equal(t, "secret", config.DB.Password)
+	assert.Equal(t, []LogConfig{
+		{Level: "debug", File: "/var/log/sprbox.log"},
+		{Level: "warning", File: "/var/log/sprbox.log"},
+	}, config.Servers)
+}
+
+func TestIncludesTOML(t *testing.T) {
+	writeConfigFile("common/log.toml", "[Log]\nLevel = \"info\"\nFile = \"sprbox.log\"", t)
+	writeConfigFile("config.toml", "\"$include\" = [\"common/log.toml\"]\nName = \"sprbox\"\n\n[Log]\nLevel = \"error\"", t)
+	defer removeConfigFiles(t)
+
+	var config LayeredConfig
+	if err := LoadConfig(&config, filepath.Join(configPath, "config.toml")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "sprbox", config.Name)
+	assert.Equal(t, LogConfig{Level: "error", File: "sprbox.log"}, config.Log)
+}
+
+func TestIncludesErrors(t *testing.T) {
+	writeConfigFile("a.yml", "$include: [b.yml]", t)
+	writeConfigFile("b.yml", "$include: [sub/c.yml]", t)
+	writeConfigFile("sub/c.yml", "$include: [../a.yml]", t)
+	writeConfigFile("missing.yml", "log: !include log.yml", t)
+	defer removeConfigFiles(t)
+
+	var config LayeredConfig
+	err := LoadConfig(&config, filepath.Join(configPath, "a.yml"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "include cycle: /tmp/sprbox/a.yml -> /tmp/sprbox/b.yml -> /tmp/sprbox/sub/c.yml -> /tmp/sprbox/a.yml")
+	}
+
+	assert.Error(t, LoadConfig(&config, filepath.Join(configPath, "missing.yml")))
+}
+
+func TestExtends(t *testing.T) {
+	BUILDENV = Development.ID()
+
+	writeConfigFile("base/Services.yml", "name: base\nlog: {level: info, file: base.log}\ndb: {db: sprbox, user: base}", t)
+	writeConfigFile("base/Services.development.yml", "log: {level: debug}", t)
+	writeConfigFile("region/Services.json", `{"$extends": "../base/Services.yml", "db": {"user": "region"}}`, t)
+	writeConfigFile("eu/Services.yml", "$extends: ../region/Services\nname: eu\nlog: {file: eu.log}", t)
+	writeConfigFile("eu/Services.development.yml", "db: {password: dev}", t)
+	defer removeConfigFiles(t)
+
+	var config LayeredConfig
+	if err := LoadConfig(&config, filepath.Join(configPath, "eu/Services")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "eu", config.Name)
+	assert.Equal(t, LogConfig{Level: "debug", File: "eu.log"}, config.Log)
+	assert.Equal(t, DBConfig{DB: "sprbox", User: "region", Password: "dev"}, config.DB)
+
+	// 'extends' without the '$' is a plain key
+	writeConfigFile("plain.yml", "extends: ../base/Services.yml\nname: plain", t)
+	var plain map[string]string
+	if err := LoadConfig(&plain, filepath.Join(configPath, "plain.yml")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string]string{"extends": "../base/Services.yml", "name": "plain"}, plain)
+}
+
+func TestExtendsCycle(t *testing.T) {
+	writeConfigFile("a.yml", "$extends: b.yml", t)
+	writeConfigFile("b.yml", "$include: [a.yml]", t)
+	defer removeConfigFiles(t)
+
+	var config LayeredConfig
+	err := LoadConfig(&config, filepath.Join(configPath, "a.yml"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "include cycle: /tmp/sprbox/a.yml -> /tmp/sprbox/b.yml -> /tmp/sprbox/a.yml")
+	}
+}
+
+func TestMultiDocument(t *testing.T) {
+	BUILDENV = Staging.ID()
+
+	writeConfigFile("Services.yml", `---
+name: base
+log: {level: info, file: base.log}
+---
+sprbox.env: production
+name: production
+---
+sprbox.env: stag.*
+log: {level: debug}
+---
+sprbox.env: [testing, staging]
+$include: [common/db.yml]
+`, t)
+	writeConfigFile("common/db.yml", "db: {db: sprbox}", t)
+	writeConfigFile("Services.staging.yml", "db: {user: staging}", t)
+	defer removeConfigFiles(t)
+
+	var config LayeredConfig
+	if err := LoadConfig(&config, filepath.Join(configPath, "Services")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "base", config.Name)
+	assert.Equal(t, LogConfig{Level: "debug", File: "base.log"}, config.Log)
+	assert.Equal(t, DBConfig{DB: "sprbox", User: "staging"}, config.DB)
+
+	writeConfigFile("Services.yml", "name: base\n---\nsprbox.env: '['\n", t)
+	assert.Error(t, LoadConfig(&config, filepath.Join(configPath, "Services.yml")), "invalid selector")
+}
+
+func TestSectioned(t *testing.T) {
+	BUILDENV = Staging.ID()
+
+	writeConfigFile("WP.yml", `
+sprbox: sectioned
+default:
+  name: default
+  log: {level: info, file: wp.log}
+production:
+  name: production
+staging:
+  log: {level: error}
+`, t)
+	writeConfigFile("WP.toml", `
+[default]
+Name = "default"
+
+[development.Log]
+Level = "debug"
+`, t)
+	defer removeConfigFiles(t)
+
+	var config LayeredConfig
+	if err := LoadConfig(&config, filepath.Join(configPath, "WP.yml")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "default", config.Name)
+	assert.Equal(t, LogConfig{Level: "error", File: "wp.log"}, config.Log)
+
+	config = LayeredConfig{}
+	if err := LoadConfigSectioned(&config, filepath.Join(configPath, "WP.toml")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "default", config.Name)
+	assert.Equal(t, LogConfig{}, config.Log)
+
+	BUILDENV = Development.ID()
+	config = LayeredConfig{}
+	if err := LoadConfigSectioned(&config, filepath.Join(configPath, "WP.toml")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, LogConfig{Level: "debug"}, config.Log)
+
+	// LoadConfig does not use sections for files without the marker
+	config = LayeredConfig{}
+	if err := LoadConfig(&config, filepath.Join(configPath, "WP.toml")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "", config.Name)
+
+	// sectioned files without sections
+	writeConfigFile("Plain.yml", "name: plain", t)
+	err := LoadConfigSectioned(&config, filepath.Join(configPath, "Plain.yml"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "sectioned config without the 'default' or 'development' section")
+	}
+
+	writeConfigFile("Prod.yml", "sprbox: sectioned\nproduction: {name: production}", t)
+	assert.Error(t, LoadConfig(&config, filepath.Join(configPath, "Prod.yml")))
+}
+
+func TestConfigDir(t *testing.T) {
+	BUILDENV = Development.ID()
+
+	writeConfigFile("conf.d/00-base.yml", "name: base\nlog: {level: info, file: base.log}", t)
+	writeConfigFile("conf.d/50-tuning.json", `{"log": {"level": "warning"}}`, t)
+	writeConfigFile("conf.d/50-tuning.development.yml", "log: {file: dev.log}", t)
+	writeConfigFile("conf.d/90-dev.development.toml", "[db]\nuser = \"dev\"", t)
+	writeConfigFile("conf.d/README.md", "not a config file", t)
+	defer removeConfigFiles(t)
+
+	var config LayeredConfig
+	if err := LoadConfigDir(&config, filepath.Join(configPath, "conf.d")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "base", config.Name)
+	assert.Equal(t, LogConfig{Level: "warning", File: "dev.log"}, config.Log)
+	assert.Equal(t, "dev", config.DB.User)
+
+	assert.Error(t, LoadConfigDir(&config, filepath.Join(configPath, "missing.d")))
+}
@@ -5,11 +5,11 @@
 package sprbox
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
 	"fmt"
+	"io/fs"
 	"net/http"
-	"os"
-	"path/filepath"
 
 	"gopkg.in/yaml.v2"
 )
@@ -38,6 +38,24 @@ var (
 
 	// fileSearchCaseSensitive determine config files search mode.
 	fileSearchCaseSensitive = true
+
+	// fileSearchOrder determine the environment-specific
+	// config files search order.
+	fileSearchOrder = EnvFileThenEnvDir
+
+	// configSearchPaths are the config search paths,
+	// highest priority first.
+	configSearchPaths []string
+
+	// configSearchMode determine how the config search paths are used.
+	configSearchMode = SearchFirstMatch
+
+	// formatPrecedence is the config files format precedence,
+	// used when the same file is found in many formats.
+	formatPrecedence []string
+
+	// configLayers resolve the extra config files layers, in order.
+	configLayers []LayerResolver
 )
 
 func init() {
@@ -104,12 +122,7 @@ func dump(v interface{}) string {
 
 // PrintInfo print some useful info about the environment and git.
 func PrintInfo() {
-	version := ""
-	sprboxRepo := NewRepository(filepath.Join(os.Getenv("GOPATH"), "/src/github.com/oblq/sprbox"))
-	if sprboxRepo.Error == nil {
-		version = "v" + sprboxRepo.Tag + "(" + sprboxRepo.Build + ")"
-	}
-	fmt.Printf(darkGrey(banner), version)
+	fmt.Printf(darkGrey(banner), sprboxVersion())
 
 	Env().PrintInfo()
 	VCS.PrintInfo()
@@ -129,3 +142,91 @@ func SetColoredLogs(colored bool) {
 func SetFileSearchCaseSensitive(caseSensitive bool) {
 	fileSearchCaseSensitive = caseSensitive
 }
+
+// SetFileSearchOrder set the search-order policy of
+// the environment-specific config files, either
+// EnvFileThenEnvDir (default), EnvDirThenEnvFile or EnvFileOnly.
+func SetFileSearchOrder(order FileSearchOrder) {
+	fileSearchOrder = order
+}
+
+// SetConfigSearchPaths set the config search paths, highest priority first
+// (eg.: "./config", "$XDG_CONFIG_HOME/app", "/etc/app").
+// Relative config files will be searched in those paths,
+// environment variables in paths are expanded.
+// If no path is set the SPRBOX_CONFIG_PATH environment variable is used.
+func SetConfigSearchPaths(paths ...string) {
+	configSearchPaths = paths
+}
+
+// SetConfigSearchMode set how the config search paths are used,
+// either SearchFirstMatch (default) or SearchLayered.
+func SetConfigSearchMode(mode ConfigSearchMode) {
+	configSearchMode = mode
+}
+
+// SetFormatPrecedence set the config files format precedence
+// by extension, highest priority first (eg.: "yml", "yaml", "json", "toml").
+// When the same config file is found in many formats (eg.: WP.yml and WP.json)
+// the one with the highest precedence is used,
+// by default an error listing the conflicting files is returned instead.
+func SetFormatPrecedence(extensions ...string) {
+	formatPrecedence = extensions
+}
+
+// SetDefaultConfigFS set a file system containing the default
+// config files (eg.: an embed.FS), they will be layered under
+// the ones found on disk, so that defaults can ship inside the binary:
+//
+//	//go:embed config
+//	var defaultConfig embed.FS
+//	...
+//	sprbox.SetDefaultConfigFS(defaultConfig)
+//	sprbox.LoadToolBox(&ToolBox, "config")
+//
+// Pass nil to remove it.
+func SetDefaultConfigFS(fsys fs.FS) {
+	defaultConfigFS = fsys
+}
+
+// SetConfigLayers set the extra config files layers,
+// layered in the given order over the environment-specific files:
+//
+//	sprbox.SetConfigLayers(sprbox.HostnameLayer, sprbox.EnvVarLayer("REGION"))
+//
+// will also load '<file>.<hostname>.*' and then '<file>.<region>.*'.
+func SetConfigLayers(layers ...LayerResolver) {
+	configLayers = layers
+}
+
+// SetBundlePublicKey set the ed25519 public key used to verify
+// the config bundles, bundles are refused if it is not set.
+func SetBundlePublicKey(publicKey ed25519.PublicKey) {
+	bundlePublicKey = publicKey
+}
+
+// SetEnvResolvers set the environment resolvers chain,
+// the first resolver able to determine the tag decide the environment:
+//
+//	sprbox.SetEnvResolvers(append(
+//		[]sprbox.EnvResolver{sprbox.MarkerFileResolver("/etc/app.env")},
+//		sprbox.DefaultEnvResolvers()...)...)
+func SetEnvResolvers(resolvers ...EnvResolver) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	envResolvers = resolvers
+}
+
+// SetDefaultEnvironment set the environment selected
+// if no registered environment match the tag, Local by default (or if env is nil).
+// It is not required to be registered.
+func SetDefaultEnvironment(env *Environment) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if env == nil {
+		env = Local
+	}
+	defaultEnvironment = env
+}
+
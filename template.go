@@ -0,0 +1,471 @@
+package sprbox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+var (
+	// customTemplateFuncs holds the functions added with AddTemplateFuncs.
+	customTemplateFuncs = template.FuncMap{}
+
+	// templateContext use the TemplateContext as the templates root
+	// in place of the config itself.
+	templateContext = false
+
+	// templateMaxDepth is the maximum number of template resolution passes.
+	templateMaxDepth = 10
+)
+
+// TemplateContext is the data passed to config files templates
+// when enabled with SetTemplateContext:
+//
+//	url: "{{.Config.Base}}/api/v1"
+//	release: "{{.Env.ID}}-{{.Git.Commit}}"
+//	home: "{{.OS.Env.HOME}}"
+type TemplateContext struct {
+	// Config is the config interface, as loaded so far.
+	Config interface{}
+
+	// Env is the current environment, Env().
+	Env struct {
+		ID          string
+		RunCompiled bool
+	}
+
+	// Git holds the VCS info, fields are empty if VCS is nil.
+	Git struct {
+		Branch string
+		Commit string
+		Tag    string
+	}
+
+	// Host is the machine hostname.
+	Host string
+
+	// OS holds the operating system data.
+	OS struct {
+		Env map[string]string
+	}
+}
+
+// SetTemplateContext use the TemplateContext as the templates root
+// in place of the config itself, eg.: "{{.Config.Base}}" instead of "{{.Base}}".
+func SetTemplateContext(enabled bool) {
+	templateContext = enabled
+}
+
+// SetTemplateMaxDepth set the maximum number of passes used to resolve
+// templates referencing other templated values, 10 by default, 1 at least.
+func SetTemplateMaxDepth(depth int) {
+	if depth < 1 {
+		depth = 1
+	}
+	templateMaxDepth = depth
+}
+
+// resolveTemplates parse all text/template placeholders
+// (eg.: {{.Key}}) in data, unmarshaling the result to config.
+// The data must be already unmarshaled to config.
+//
+// Templates are executed again against the updated config
+// as many times as the longest chain of templated values referencing
+// each other, so that they are fully resolved, or until the result is stable.
+// The 'ref' template func is resolved by refs, if any.
+func resolveTemplates(data []byte, config interface{}, name string, unmarshal unmarshaler, refs *refResolver) error {
+	tpl, err := template.New(name).Funcs(templateFuncs(refs)).Parse(string(data))
+	if err != nil {
+		return err
+	}
+
+	passes, err := templateDepth(data, unmarshal)
+	if err != nil {
+		return err
+	} else if passes > templateMaxDepth {
+		return fmt.Errorf("%s: templates not resolved after %d passes", name, templateMaxDepth)
+	} else if passes == 0 {
+		// unknown dependencies
+		passes = templateMaxDepth
+	}
+
+	previous := data
+	for pass := 0; pass < passes; pass++ {
+		var buf bytes.Buffer
+		if err = tpl.Execute(&buf, templateData(config)); err != nil {
+			return err
+		}
+
+		if bytes.Equal(buf.Bytes(), previous) {
+			return nil
+		}
+
+		if err = unmarshal(buf.Bytes(), config, name); err != nil {
+			return err
+		}
+		previous = buf.Bytes()
+	}
+	return nil
+}
+
+// templateDepth returns the length of the longest chain of templated
+// values referencing each other, 1 at least, the number of passes needed to
+// resolve them, or an error describing the first reference cycle found.
+// It returns 0 if data can not be decoded to a generic interface.
+func templateDepth(data []byte, unmarshal unmarshaler) (int, error) {
+	var generic interface{}
+	if err := unmarshal(data, &generic, ""); err != nil {
+		return 0, nil
+	}
+
+	// templated values path -> referenced paths
+	refs := make(map[string][]string)
+	collectTemplateRefs(generic, "", refs)
+
+	paths := make([]string, 0, len(refs))
+	for path := range refs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// dependsOn returns the templated values referenced by path,
+	// references to its ancestors (eg.: '{{ len .Parent }}') are ignored.
+	dependsOn := func(path string) (deps []string) {
+		for _, ref := range refs[path] {
+			if strings.HasPrefix(path, ref+".") {
+				continue
+			}
+			for _, dep := range paths {
+				if dep == ref || strings.HasPrefix(dep, ref+".") || strings.HasPrefix(ref, dep+".") {
+					deps = append(deps, dep)
+				}
+			}
+		}
+		return
+	}
+
+	// depths holds the chain length of the visited paths
+	depths := make(map[string]int)
+	var stack []string
+	var visit func(path string) (int, []string)
+	visit = func(path string) (int, []string) {
+		for i, p := range stack {
+			if p == path {
+				return 0, append(append([]string{}, stack[i:]...), path)
+			}
+		}
+		if depth, visited := depths[path]; visited {
+			return depth, nil
+		}
+
+		stack = append(stack, path)
+		defer func() { stack = stack[:len(stack)-1] }()
+
+		depth := 1
+		for _, dep := range dependsOn(path) {
+			depDepth, cycle := visit(dep)
+			if cycle != nil {
+				return 0, cycle
+			}
+			if depDepth+1 > depth {
+				depth = depDepth + 1
+			}
+		}
+		depths[path] = depth
+		return depth, nil
+	}
+
+	maxDepth := 1
+	for _, path := range paths {
+		depth, cycle := visit(path)
+		if cycle != nil {
+			return 0, fmt.Errorf("template reference cycle: %s", strings.Join(cycle, " -> "))
+		}
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+	}
+	return maxDepth, nil
+}
+
+// collectTemplateRefs walk the generic config data and map
+// the (lowercased) path of every templated string value
+// to the config paths referenced in its template.
+func collectTemplateRefs(value interface{}, path string, refs map[string][]string) {
+	join := func(key interface{}) string {
+		k := strings.ToLower(fmt.Sprint(key))
+		if len(path) == 0 {
+			return k
+		}
+		return path + "." + k
+	}
+
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		for key, elem := range v {
+			collectTemplateRefs(elem, join(key), refs)
+		}
+	case map[string]interface{}:
+		for key, elem := range v {
+			collectTemplateRefs(elem, join(key), refs)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			collectTemplateRefs(elem, join(i), refs)
+		}
+	case string:
+		if !strings.Contains(v, "{{") {
+			return
+		}
+		tpl, err := template.New("").Funcs(templateFuncs(nil)).Parse(v)
+		if err != nil {
+			return
+		}
+		refs[path] = templateNodeRefs(tpl.Tree.Root, nil)
+	}
+}
+
+// templateNodeRefs returns the config paths referenced by the template node.
+func templateNodeRefs(node parse.Node, refs []string) []string {
+	addRef := func(ident []string) []string {
+		if templateContext {
+			if len(ident) < 2 || ident[0] != "Config" {
+				return refs
+			}
+			ident = ident[1:]
+		}
+		return append(refs, strings.ToLower(strings.Join(ident, ".")))
+	}
+
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			for _, child := range n.Nodes {
+				refs = templateNodeRefs(child, refs)
+			}
+		}
+	case *parse.ActionNode:
+		refs = templateNodeRefs(n.Pipe, refs)
+	case *parse.PipeNode:
+		if n != nil {
+			for _, cmd := range n.Cmds {
+				refs = templateNodeRefs(cmd, refs)
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			refs = templateNodeRefs(arg, refs)
+		}
+	case *parse.FieldNode:
+		refs = addRef(n.Ident)
+	case *parse.VariableNode:
+		if len(n.Ident) > 1 && n.Ident[0] == "$" {
+			refs = addRef(n.Ident[1:])
+		}
+	case *parse.IfNode:
+		refs = templateBranchRefs(&n.BranchNode, refs)
+	case *parse.RangeNode:
+		refs = templateBranchRefs(&n.BranchNode, refs)
+	case *parse.WithNode:
+		refs = templateBranchRefs(&n.BranchNode, refs)
+	case *parse.TemplateNode:
+		refs = templateNodeRefs(n.Pipe, refs)
+	}
+	return refs
+}
+
+func templateBranchRefs(n *parse.BranchNode, refs []string) []string {
+	refs = templateNodeRefs(n.Pipe, refs)
+	refs = templateNodeRefs(n.List, refs)
+	return templateNodeRefs(n.ElseList, refs)
+}
+
+// templateData returns the data to execute config templates with.
+func templateData(config interface{}) interface{} {
+	if !templateContext {
+		return config
+	}
+
+	ctx := TemplateContext{Config: config}
+
+	env := Env()
+	ctx.Env.ID = env.ID()
+	ctx.Env.RunCompiled = env.RunCompiled
+
+	if VCS != nil {
+		ctx.Git.Branch = VCS.BranchName
+		ctx.Git.Commit = VCS.Commit
+		ctx.Git.Tag = VCS.Tag
+	}
+
+	ctx.Host, _ = os.Hostname()
+
+	ctx.OS.Env = make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			ctx.OS.Env[kv[:i]] = kv[i+1:]
+		}
+	}
+
+	return ctx
+}
+
+// AddTemplateFuncs add custom functions to the ones
+// available in config files templates.
+// Builtin functions with the same name will be overridden.
+//
+// Builtin functions:
+//   - env "KEY"               -> the KEY environment variable value
+//   - default "def" .Value    -> .Value or "def" if .Value is empty
+//   - required "msg" .Value   -> .Value or an error if .Value is empty
+//   - readFile "path"         -> the file content
+//   - base64 "text"           -> the base64 encoded text
+//   - hostname                -> the machine hostname
+//   - envID                   -> Env().ID()
+//   - git "Commit"            -> the VCS field value (BranchName, Commit, Build, Tag or Path)
+//   - upper "text", lower "text"
+//   - join ", " .List, split "," "a,b"
+//   - ref "Services.storage.Port" -> a value from another toolbox field config (LoadConfigFS in SpareConfigFS only)
+func AddTemplateFuncs(funcs template.FuncMap) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for name, fn := range funcs {
+		customTemplateFuncs[name] = fn
+	}
+}
+
+// templateFuncs returns the builtin functions merged with the custom ones,
+// 'ref' is resolved by refs.
+func templateFuncs(refs *refResolver) template.FuncMap {
+	funcs := template.FuncMap{
+		"env":      os.Getenv,
+		"default":  tplDefault,
+		"required": tplRequired,
+		"readFile": tplReadFile,
+		"base64":   tplBase64,
+		"hostname": os.Hostname,
+		"envID":    tplEnvID,
+		"git":      tplGit,
+		"upper":    strings.ToUpper,
+		"lower":    strings.ToLower,
+		"join":     tplJoin,
+		"split":    tplSplit,
+		"ref":      refs.tplRef,
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for name, fn := range customTemplateFuncs {
+		funcs[name] = fn
+	}
+	return funcs
+}
+
+// isEmpty returns true for nil, zero values and empty collections.
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	default:
+		return reflect.DeepEqual(value, reflect.Zero(v.Type()).Interface())
+	}
+}
+
+// tplDefault returns def if value is missing or empty.
+// The value is the last argument so it can be piped:
+//
+//	{{ env "PORT" | default "8080" }}
+func tplDefault(def interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || isEmpty(value[0]) {
+		return def
+	}
+	return value[0]
+}
+
+// tplRequired returns an error with the given message if value is missing or empty:
+//
+//	{{ env "DB_PASSWORD" | required "DB_PASSWORD is required" }}
+func tplRequired(msg string, value ...interface{}) (interface{}, error) {
+	if len(value) == 0 || isEmpty(value[0]) {
+		return nil, errors.New(msg)
+	}
+	return value[0], nil
+}
+
+func tplReadFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	return string(data), err
+}
+
+func tplBase64(text string) string {
+	return base64.StdEncoding.EncodeToString([]byte(text))
+}
+
+func tplEnvID() string {
+	return Env().ID()
+}
+
+// tplGit returns the requested VCS field value.
+func tplGit(field string) (string, error) {
+	if VCS == nil {
+		return "", errors.New("git: VCS is nil")
+	}
+
+	switch strings.ToLower(field) {
+	case "branchname", "branch":
+		return VCS.BranchName, nil
+	case "commit":
+		return VCS.Commit, nil
+	case "build":
+		return VCS.Build, nil
+	case "tag":
+		return VCS.Tag, nil
+	case "path":
+		return VCS.Path, nil
+	default:
+		return "", fmt.Errorf("git: unknown field '%s'", field)
+	}
+}
+
+// tplJoin join the list elements using sep.
+func tplJoin(sep string, list interface{}) (string, error) {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return "", fmt.Errorf("join: can't join a value of type %T", list)
+	}
+
+	elems := make([]string, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		elems[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strings.Join(elems, sep), nil
+}
+
+func tplSplit(sep string, text string) []string {
+	return strings.Split(text, sep)
+}
+
+// tplRef returns a value from the raw config of another toolbox field.
+func (r *refResolver) tplRef(path string) (interface{}, error) {
+	if r == nil {
+		return nil, fmt.Errorf("ref: '%s' can only be resolved inside LoadToolBox, by LoadConfigFS in SpareConfigFS", path)
+	}
+	return r.resolve(path)
+}
@@ -0,0 +1,272 @@
+package sprbox
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"text/template"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ConfigWFuncs struct {
+	Env      string
+	Default  string
+	ReadFile string
+	Base64   string
+	Hostname string
+	EnvID    string
+	Git      string
+	Upper    string
+	Lower    string
+	Join     string
+	Split    string
+	Custom   string
+}
+
+func TestTemplateFuncs(t *testing.T) {
+	saveEnvironments(t)
+
+	BUILDENV = Development.ID()
+	VCS = NewRepository("./")
+
+	os.Setenv("SPRBOX_TPL", "from env")
+	defer os.Unsetenv("SPRBOX_TPL")
+
+	writeFiles("secret.txt", []byte("s3cr3t"), t)
+	defer removeConfigFiles(t)
+
+	AddTemplateFuncs(template.FuncMap{"custom": func() string { return "custom" }})
+
+	file := []byte(`
+env: '{{ env "SPRBOX_TPL" }}'
+default: '{{ env "SPRBOX_TPL_MISSING" | default "default" }}'
+readfile: '{{ readFile "` + filepath.Join(configPath, "secret.txt") + `" }}'
+base64: '{{ base64 "sprbox" }}'
+hostname: '{{ hostname }}'
+envid: '{{ envID }}'
+git: '{{ git "Commit" }}'
+upper: '{{ upper "sprbox" }}'
+lower: '{{ lower "SPRBOX" }}'
+join: '{{ split "," "a,b,c" | join "-" }}'
+split: '{{ index (split "," "a,b,c") 1 }}'
+custom: '{{ custom }}'
+`)
+
+	var config ConfigWFuncs
+	if err := Unmarshal(file, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	hostname, _ := os.Hostname()
+
+	assert.Equal(t, "from env", config.Env)
+	assert.Equal(t, "default", config.Default)
+	assert.Equal(t, "s3cr3t", config.ReadFile)
+	assert.Equal(t, "c3ByYm94", config.Base64)
+	assert.Equal(t, hostname, config.Hostname)
+	assert.Equal(t, Development.ID(), config.EnvID)
+	assert.Equal(t, VCS.Commit, config.Git)
+	assert.Equal(t, "SPRBOX", config.Upper)
+	assert.Equal(t, "sprbox", config.Lower)
+	assert.Equal(t, "a-b-c", config.Join)
+	assert.Equal(t, "b", config.Split)
+	assert.Equal(t, "custom", config.Custom)
+}
+
+func TestTemplateFuncRequired(t *testing.T) {
+	createYAML(map[string]string{"env": `{{ env "SPRBOX_TPL_MISSING" | required "SPRBOX_TPL_MISSING is required" }}`}, "config.yml", t)
+	defer removeConfigFiles(t)
+
+	var config ConfigWFuncs
+	err := LoadConfig(&config, filepath.Join(configPath, "config.yml"))
+	if assert.Error(t, err) {
+		assert.True(t, strings.Contains(err.Error(), "SPRBOX_TPL_MISSING is required"), err.Error())
+	}
+}
+
+func TestTemplateFuncGit(t *testing.T) {
+	saveEnvironments(t)
+
+	VCS = &Repository{BranchName: "master", Commit: "abc123", Build: "42", Tag: "v1.0.0", Path: "./"}
+	for field, expected := range map[string]string{
+		"BranchName": "master",
+		"branch":     "master",
+		"Commit":     "abc123",
+		"Build":      "42",
+		"Tag":        "v1.0.0",
+		"Path":       "./",
+	} {
+		value, err := tplGit(field)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, value)
+	}
+
+	_, err := tplGit("wrong")
+	assert.Error(t, err)
+
+	VCS = nil
+	_, err = tplGit("Commit")
+	assert.Error(t, err)
+}
+
+type ConfigWContext struct {
+	Name    string
+	Env     string
+	Compile string
+	Git     string
+	Host    string
+	Home    string
+}
+
+func TestTemplateContext(t *testing.T) {
+	saveEnvironments(t)
+	SetTemplateContext(true)
+	defer SetTemplateContext(false)
+
+	BUILDENV = Staging.ID()
+	VCS = &Repository{BranchName: "release/1.0", Commit: "abc123", Tag: "v1.0.0"}
+
+	os.Setenv("SPRBOX_TPL", "from env")
+	defer os.Unsetenv("SPRBOX_TPL")
+
+	file := []byte(`
+name: sprbox
+env: '{{.Config.Name}}-{{.Env.ID}}'
+compile: '{{.Env.RunCompiled}}'
+git: '{{.Git.Branch}}@{{.Git.Commit}}-{{.Git.Tag}}'
+host: '{{.Host}}'
+home: '{{.OS.Env.SPRBOX_TPL}}'
+`)
+
+	var config ConfigWContext
+	if err := Unmarshal(file, &config); err != nil {
+		t.Fatal(err)
+	}
+
+	hostname, _ := os.Hostname()
+
+	assert.Equal(t, "sprbox-staging", config.Env)
+	assert.Equal(t, "true", config.Compile)
+	assert.Equal(t, "release/1.0@abc123-v1.0.0", config.Git)
+	assert.Equal(t, hostname, config.Host)
+	assert.Equal(t, "from env", config.Home)
+}
+
+type ConfigWChain struct {
+	C string
+	B string
+	A string
+}
+
+func TestTemplateChain(t *testing.T) {
+	file := []byte(`
+c: '{{.B}}-z'
+b: '{{.A}}-y'
+a: x
+`)
+	writeFiles("chain.yml", file, t)
+	defer removeConfigFiles(t)
+
+	var uConfig ConfigWChain
+	if err := Unmarshal(file, &uConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	var lConfig ConfigWChain
+	if err := LoadConfig(&lConfig, filepath.Join(configPath, "chain.yml")); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, "x-y-z", uConfig.C)
+	assert.Equal(t, "x-y", uConfig.B)
+	assert.Equal(t, uConfig, lConfig)
+
+	// c -> b -> a needs 2 passes
+	SetTemplateMaxDepth(2)
+	defer SetTemplateMaxDepth(10)
+
+	var config ConfigWChain
+	assert.NoError(t, Unmarshal(file, &config))
+	assert.Equal(t, "x-y-z", config.C)
+
+	SetTemplateMaxDepth(1)
+	config = ConfigWChain{}
+	assert.Error(t, Unmarshal(file, &config), "max depth not respected")
+
+	// depth is 1 at least
+	SetTemplateMaxDepth(0)
+	config = ConfigWChain{}
+	assert.NoError(t, Unmarshal([]byte("a: x"), &config))
+	assert.Equal(t, "x", config.A)
+}
+
+func TestTemplateUnstable(t *testing.T) {
+	var counter int
+	AddTemplateFuncs(template.FuncMap{"counter": func() int { counter++; return counter }})
+	defer delete(customTemplateFuncs, "counter")
+
+	var config ConfigWChain
+	if err := Unmarshal([]byte("a: '{{ counter }}'\nb: '{{.A}}-y'"), &config); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "2", config.A)
+	assert.Equal(t, "1-y", config.B)
+}
+
+func TestTemplateCycle(t *testing.T) {
+	file := []byte(`
+c: '{{.B}}'
+b: '{{.A}} {{ upper "-" }}'
+a: '{{ .C | lower }}'
+`)
+
+	var config ConfigWChain
+	err := Unmarshal(file, &config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "template reference cycle: a -> c -> b -> a")
+	}
+
+	SetTemplateContext(true)
+	defer SetTemplateContext(false)
+
+	file = []byte(`{"A": "{{.Config.A}}"}`)
+	err = Unmarshal(file, &config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "template reference cycle: a -> a")
+	}
+}
+
+type ConfigWParentRef struct {
+	API struct {
+		Name string
+		Desc string
+	}
+	Sub map[string]string
+}
+
+func TestTemplateParentRef(t *testing.T) {
+	SetTemplateContext(true)
+	defer SetTemplateContext(false)
+
+	var config ConfigWParentRef
+	file := []byte(`
+api:
+  name: sprbox
+  desc: '{{ with .Config.API }}{{ .Name }}{{ end }}'
+`)
+	if assert.NoError(t, Unmarshal(file, &config)) {
+		assert.Equal(t, "sprbox", config.API.Desc)
+	}
+
+	config = ConfigWParentRef{}
+	file = []byte(`
+sub:
+  a: x
+  count: '{{ len .Config.Sub }}'
+`)
+	if assert.NoError(t, Unmarshal(file, &config)) {
+		assert.Equal(t, "2", config.Sub["count"])
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v2"
@@ -14,6 +16,9 @@ import (
 // Struct field flags.
 const (
 	sftSkip = "-"
+
+	// sftDir load all the config files in a directory: `sprbox:"dir=WP.d"`.
+	sftDir = "dir="
 )
 
 // Errors.
@@ -21,12 +26,19 @@ var (
 	errInvalidPointer              = errors.New("<box> parameter should be a struct pointer")
 	errNotConfigurable             = errors.New("does not implement the 'configurable' interface: `func SpareConfig([]string) error`")
 	errNotConfigurableInCollection = errors.New("does not implement the 'configurable' interface nor its elements implements the 'configurableInCollection' one: `func SpareConfigBytes([]byte) error`")
+	errNotConfigurableFS           = errors.New("does not implement the 'configurableFS' interface: `func SpareConfigFS(fs.FS, []string) error`")
 )
 
 type configurable interface {
 	SpareConfig([]string) error
 }
 
+// configurableFS is optional, if implemented it is used in place
+// of 'configurable', it is required in LoadToolBoxFS.
+type configurableFS interface {
+	SpareConfigFS(fs.FS, []string) error
+}
+
 type configurableInCollection interface {
 	SpareConfigBytes([]byte) error
 }
@@ -36,7 +48,35 @@ type configurableInCollection interface {
 
 // LoadToolBox initialize and (eventually) configure the provided struct pointer
 // looking for the config files in the provided configPath.
+//
+// If config search paths are set (see SetConfigSearchPaths())
+// a relative configPath is looked up in each of them.
+//
+// configPath can also be a signed config bundle (eg.: config.tar.gz),
+// see CreateBundle() and SetBundlePublicKey().
 func LoadToolBox(toolBox interface{}, configPath string) (err error) {
+	if isBundle(configPath) {
+		var bundle fs.FS
+		if bundle, err = OpenBundle(configPath); err != nil {
+			return err
+		}
+		return LoadToolBoxFS(bundle, toolBox, ".")
+	}
+	return loadToolBox(newToolBoxFS(nil), toolBox, configPath)
+}
+
+// LoadToolBoxFS is like LoadToolBox but the config files are
+// searched in fsys (eg.: an embed.FS), configPath is a
+// slash-separated path relative to its root.
+//
+// The toolbox fields must implement the 'configurableFS' interface,
+// pass the received fs.FS to LoadConfigFS to load the config files.
+func LoadToolBoxFS(fsys fs.FS, toolBox interface{}, configPath string) error {
+	return loadToolBox(newToolBoxFS(fsys), toolBox, configPath)
+}
+
+// loadToolBox configure the toolBox fields with the config files in tbFS.
+func loadToolBox(tbFS *toolBoxFS, toolBox interface{}, configPath string) (err error) {
 	t := reflect.TypeOf(toolBox).Elem()
 	v := reflect.ValueOf(toolBox).Elem()
 
@@ -46,10 +86,12 @@ func LoadToolBox(toolBox interface{}, configPath string) (err error) {
 		return errInvalidPointer // nil pointer
 	}
 
+	tbFS.refs = newRefResolver(tbFS, configPath, t)
+
 	for i := 0; i < v.NumField(); i++ {
 		sf := t.Field(i)
 		fv := v.Field(i)
-		if err = loadField(configPath, &sf, fv, 0); err != nil {
+		if err = loadField(tbFS, configPath, &sf, fv, 0); err != nil {
 			break
 		}
 	}
@@ -58,8 +100,16 @@ func LoadToolBox(toolBox interface{}, configPath string) (err error) {
 	return
 }
 
+// isConfigurable returns true if v implements
+// the 'configurable' or the 'configurableFS' interface.
+func isConfigurable(v interface{}) bool {
+	_, isConfigurable := v.(configurable)
+	_, isConfigurableFS := v.(configurableFS)
+	return isConfigurable || isConfigurableFS
+}
+
 // level is the parent grade to the initially passed fv
-func loadField(configPath string, sf *reflect.StructField, fv reflect.Value, level int) error {
+func loadField(tbFS *toolBoxFS, configPath string, sf *reflect.StructField, fv reflect.Value, level int) error {
 	switch fv.Kind() {
 	case reflect.Ptr:
 		if tag, found := sf.Tag.Lookup(sftKey); found && tag == sftSkip {
@@ -74,7 +124,7 @@ func loadField(configPath string, sf *reflect.StructField, fv reflect.Value, lev
 		if fv.IsNil() {
 			fv.Set(reflect.New(fv.Type().Elem()))
 		}
-		return loadField(configPath, sf, fv.Elem(), level)
+		return loadField(tbFS, configPath, sf, fv.Elem(), level)
 
 	case reflect.Struct:
 		// !reflect.Zero(fv.Type()) is an already configured field, so sprbox will skip it.
@@ -90,8 +140,8 @@ func loadField(configPath string, sf *reflect.StructField, fv reflect.Value, lev
 
 		fv.Set(reflect.New(fv.Type()).Elem())
 
-		if _, isConfigurable := fv.Addr().Interface().(configurable); isConfigurable {
-			if err := configure(configPath, configFiles, sf, fv.Addr(), level); err != nil {
+		if isConfigurable(fv.Addr().Interface()) {
+			if err := configure(tbFS, configPath, configFiles, sf, fv.Addr(), level); err != nil {
 				return err
 			}
 		} else {
@@ -104,7 +154,7 @@ func loadField(configPath string, sf *reflect.StructField, fv reflect.Value, lev
 			sfv := fv.Field(i)
 			verbosePrintf("%ssub-field: %s\n", strings.Repeat(" -> ", level), ssf.Name)
 			//subPath := filepath.Join(configPath, sf.Name)
-			if err := loadField(configPath, &ssf, sfv, level); err != nil {
+			if err := loadField(tbFS, configPath, &ssf, sfv, level); err != nil {
 				return err
 			}
 		}
@@ -125,8 +175,8 @@ func loadField(configPath string, sf *reflect.StructField, fv reflect.Value, lev
 
 		fv.Set(reflect.New(fv.Type()).Elem())
 
-		if _, isConfigurable := fv.Addr().Interface().(configurable); isConfigurable {
-			if err := configure(configPath, configFiles, sf, fv.Addr(), level); err != nil {
+		if isConfigurable(fv.Addr().Interface()) {
+			if err := configure(tbFS, configPath, configFiles, sf, fv.Addr(), level); err != nil {
 				return err
 			}
 		} else {
@@ -142,12 +192,14 @@ func loadField(configPath string, sf *reflect.StructField, fv reflect.Value, lev
 
 			level += 1
 
-			for i, file := range configFiles {
-				configFiles[i] = filepath.Join(configPath, file)
+			configFiles, err := configFilePaths(tbFS, configPath, configFiles)
+			if err != nil {
+				printLoadResult(sf.Name, sf.Type.Elem(), err, level)
+				return err
 			}
 
 			var config []interface{}
-			if err := LoadConfig(&config, configFiles...); err != nil {
+			if err := LoadConfigFS(tbFS, &config, configFiles...); err != nil {
 				printLoadResult(sf.Name, sf.Type.Elem(), err, level)
 				return err
 			}
@@ -193,8 +245,8 @@ func loadField(configPath string, sf *reflect.StructField, fv reflect.Value, lev
 
 		fv.Set(reflect.New(fv.Type()).Elem())
 
-		if _, isConfigurable := fv.Addr().Interface().(configurable); isConfigurable {
-			if err := configure(configPath, configFiles, sf, fv.Addr(), level); err != nil {
+		if isConfigurable(fv.Addr().Interface()) {
+			if err := configure(tbFS, configPath, configFiles, sf, fv.Addr(), level); err != nil {
 				return err
 			}
 		} else {
@@ -210,12 +262,14 @@ func loadField(configPath string, sf *reflect.StructField, fv reflect.Value, lev
 
 			level += 1
 
-			for i, file := range configFiles {
-				configFiles[i] = filepath.Join(configPath, file)
+			configFiles, err := configFilePaths(tbFS, configPath, configFiles)
+			if err != nil {
+				printLoadResult(sf.Name, fv.Type(), err, level)
+				return err
 			}
 
 			var config map[string]interface{}
-			if err := LoadConfig(&config, configFiles...); err != nil {
+			if err := LoadConfigFS(tbFS, &config, configFiles...); err != nil {
 				printLoadResult(sf.Name, fv.Type(), err, level)
 				return err
 			}
@@ -261,6 +315,7 @@ func loadField(configPath string, sf *reflect.StructField, fv reflect.Value, lev
 // the field name without extension will be returned in that case,
 // loadConfig will look for a file with that prefix and any kind
 // of extension, if necessary (no '.' in file name).
+// Directories (`dir=WP.d`) are expanded by configFilePaths.
 func parseTags(configFiles *[]string, f *reflect.StructField) (skip bool) {
 	tag, found := f.Tag.Lookup(sftKey)
 	if !found {
@@ -281,13 +336,26 @@ func parseTags(configFiles *[]string, f *reflect.StructField) (skip bool) {
 	return
 }
 
-// configure will call the 'configurable' interface on the passed field struct pointer.
-func configure(configPath string, configFiles []string, f *reflect.StructField, v reflect.Value, level int) error {
-	for i, file := range configFiles {
-		configFiles[i] = filepath.Join(configPath, file)
+// configure will call the 'configurableFS' interface, or else the 'configurable' one,
+// on the passed field struct pointer.
+func configure(tbFS *toolBoxFS, configPath string, configFiles []string, f *reflect.StructField, v reflect.Value, level int) error {
+	configFiles, err := configFilePaths(tbFS, configPath, configFiles)
+	if err != nil {
+		printLoadResult(f.Name, f.Type, err, level)
+		return err
 	}
 
-	if err := v.Interface().(configurable).SpareConfig(configFiles); err != nil {
+	switch c := v.Interface().(type) {
+	case configurableFS:
+		err = c.SpareConfigFS(tbFS, configFiles)
+	case configurable:
+		if tbFS.mounted {
+			err = errNotConfigurableFS
+		} else {
+			err = c.SpareConfig(configFiles)
+		}
+	}
+	if err != nil {
 		printLoadResult(f.Name, f.Type, err, level)
 		return err
 	}
@@ -296,6 +364,29 @@ func configure(configPath string, configFiles []string, f *reflect.StructField,
 	return nil
 }
 
+// configFilePaths join the config files to the configPath,
+// `dir=<dir>` entries are replaced by the files in <dir>
+// and glob patterns (eg.: `MediaProcessing/*.yml`, `tenants/**/Services`)
+// by the matched files in tbFS, in lexicographic order.
+func configFilePaths(tbFS *toolBoxFS, configPath string, configFiles []string) (paths []string, err error) {
+	for _, file := range configFiles {
+		pattern := filepath.Join(configPath, file)
+		if strings.HasPrefix(file, sftDir) {
+			pattern = filepath.Join(configPath, strings.TrimPrefix(file, sftDir), "*")
+		} else if !isGlob(file) {
+			paths = append(paths, pattern)
+			continue
+		}
+
+		var matchedFiles []string
+		if matchedFiles, err = configGlobFiles(tbFS.fss, pattern); err != nil {
+			return nil, err
+		}
+		paths = append(paths, matchedFiles...)
+	}
+	return
+}
+
 // configureElem will call the 'configurableInCollection' interface on the passed struct pointer.
 func configureElem(elem reflect.Value, config interface{}, sfName string, level int) (err error) {
 	var bytes []byte
@@ -339,3 +430,167 @@ func printLoadResult(objNameType string, t reflect.Type, err error, level int) {
 		fmt.Printf("%s %s\n", objNameType, green("<- config loaded"))
 	}
 }
+
+// REFERENCES ----------------------------------------------------------------------------------------------------------
+
+// refResolver load the raw config of the toolbox fields
+// referenced in templates (eg.: {{ ref "Services.storage.Port" }}).
+// Raw configs are loaded on demand, so the referenced
+// ones are always loaded before the referencing ones.
+type refResolver struct {
+	// tbFS holds the toolbox file systems.
+	tbFS *toolBoxFS
+
+	// files holds the config files for every toolbox field path
+	// (eg.: "MediaProcessing.Pictures").
+	files map[string][]string
+
+	// configs holds the already loaded raw configs.
+	configs map[string]interface{}
+
+	// loading is the stack of the raw configs being loaded,
+	// used to detect reference cycles.
+	loading []string
+}
+
+func newRefResolver(tbFS *toolBoxFS, configPath string, t reflect.Type) *refResolver {
+	r := &refResolver{
+		tbFS:    tbFS,
+		files:   make(map[string][]string),
+		configs: make(map[string]interface{}),
+	}
+	r.collectFiles(configPath, t, "")
+	return r
+}
+
+// collectFiles map the config files of every loadable field
+// in the toolbox, following the same rules of loadField.
+func (r *refResolver) collectFiles(configPath string, t reflect.Type, prefix string) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.Anonymous || len(sf.PkgPath) > 0 {
+			continue
+		}
+
+		ft := sf.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		name := prefix + sf.Name
+		isConfigurable := reflect.PtrTo(ft).Implements(reflect.TypeOf((*configurable)(nil)).Elem()) ||
+			reflect.PtrTo(ft).Implements(reflect.TypeOf((*configurableFS)(nil)).Elem())
+
+		switch ft.Kind() {
+		case reflect.Struct, reflect.Slice, reflect.Map:
+			configFiles := []string{sf.Name}
+			if skip := parseTags(&configFiles, &sf); skip {
+				continue
+			}
+
+			if ft.Kind() == reflect.Struct && !isConfigurable {
+				r.collectFiles(configPath, ft, name+".")
+				continue
+			}
+
+			if configFiles, err := configFilePaths(r.tbFS, configPath, configFiles); err == nil {
+				r.files[name] = configFiles
+			}
+		}
+	}
+}
+
+// resolve returns the value at the given path,
+// the path must start with a toolbox field path.
+func (r *refResolver) resolve(path string) (interface{}, error) {
+	name := ""
+	for fieldPath := range r.files {
+		if (path == fieldPath || strings.HasPrefix(path, fieldPath+".")) && len(fieldPath) > len(name) {
+			name = fieldPath
+		}
+	}
+	if len(name) == 0 {
+		return nil, fmt.Errorf("ref: no toolbox field found for '%s'", path)
+	}
+
+	config, err := r.rawConfig(name)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := strings.Split(strings.TrimPrefix(strings.TrimPrefix(path, name), "."), ".")
+	if len(keys) == 1 && len(keys[0]) == 0 {
+		return config, nil
+	}
+
+	value, found := lookupPath(config, keys)
+	if !found {
+		return nil, fmt.Errorf("ref: '%s' not found", path)
+	}
+	return value, nil
+}
+
+// rawConfig load the config files of the given toolbox field in a generic interface.
+func (r *refResolver) rawConfig(name string) (interface{}, error) {
+	if config, loaded := r.configs[name]; loaded {
+		return config, nil
+	}
+
+	for i, loading := range r.loading {
+		if loading == name {
+			cycle := append(append([]string{}, r.loading[i:]...), name)
+			return nil, fmt.Errorf("ref: reference cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	r.loading = append(r.loading, name)
+	defer func() { r.loading = r.loading[:len(r.loading)-1] }()
+
+	var config interface{}
+	if err := LoadConfigFS(r.tbFS, &config, r.files[name]...); err != nil {
+		return nil, err
+	}
+
+	r.configs[name] = config
+	return config, nil
+}
+
+// lookupPath walk maps and slices following the given keys,
+// map keys are matched case-insensitively if an exact match is not found.
+func lookupPath(value interface{}, keys []string) (interface{}, bool) {
+	for _, key := range keys {
+		v := reflect.ValueOf(value)
+		if !v.IsValid() {
+			return nil, false
+		}
+
+		switch v.Kind() {
+		case reflect.Map:
+			var found reflect.Value
+			for _, k := range v.MapKeys() {
+				kString := fmt.Sprint(k.Interface())
+				if kString == key {
+					found = k
+					break
+				} else if !found.IsValid() && strings.EqualFold(kString, key) {
+					found = k
+				}
+			}
+			if !found.IsValid() {
+				return nil, false
+			}
+			value = v.MapIndex(found).Interface()
+
+		case reflect.Slice, reflect.Array:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= v.Len() {
+				return nil, false
+			}
+			value = v.Index(i).Interface()
+
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
@@ -2,6 +2,7 @@ package sprbox
 
 import (
 	"errors"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -350,3 +351,123 @@ func TestBoxAfterConfig(t *testing.T) {
 	assert.NotEqual(t, 0, len(test.Tool1.Config.Path), "test1.Config.Path:", test.Tool1.Config.Path)
 	assert.Equal(t, tString, test.Tool2.Config.Path, "test2.Path:", test.Tool2.Config.Path)
 }
+
+type BoxRefs struct {
+	Tool1 fsTool
+	Sub   struct {
+		Tool2 *fsTool
+	}
+	Tools map[string]Tool
+}
+
+func TestBoxRefs(t *testing.T) {
+	writeFiles("Tool1.yml", []byte(`path: '{{ ref "Sub.Tool2.Path" }}/{{ ref "Tools.test1.path" }}'`), t)
+	writeFiles("Tool2.yml", []byte(`path: '{{ ref "Tools.test2.path" }}'`), t)
+	createYAML(map[string]ToolConfig{
+		"test1": {Path: "tool1"},
+		"test2": {Path: configPath},
+	}, "Tools.yml", t)
+	defer removeConfigFiles(t)
+
+	var test BoxRefs
+	if err := LoadToolBox(&test, configPath); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, configPath+"/tool1", test.Tool1.Config.Path)
+	assert.Equal(t, configPath, test.Sub.Tool2.Config.Path)
+	assert.Equal(t, configPath, test.Tools["test2"].Config.Path)
+
+	var config ToolConfig
+	assert.Error(t, LoadConfig(&config, filepath.Join(configPath, "Tool1.yml")), "ref outside LoadToolBox")
+
+	// ref is resolved by LoadConfigFS in the 'configurableFS' interface only
+	var box struct{ Tool1 Tool }
+	assert.Error(t, LoadToolBox(&box, configPath), "ref in the 'configurable' interface")
+}
+
+// subBoxTool load a sub-toolbox in its 'configurable' implementation.
+type subBoxTool struct {
+	Config ToolConfig
+	Sub    struct{ Tool3 Tool }
+}
+
+func (s *subBoxTool) SpareConfig(files []string) error {
+	if err := LoadConfig(&s.Config, files...); err != nil {
+		return err
+	}
+	return LoadToolBox(&s.Sub, filepath.Join(configPath, "sub"))
+}
+
+func TestNestedBoxRefs(t *testing.T) {
+	writeConfigFile("Tool1.yml", "path: '{{ ref \"Tool2.Path\" }}'", t)
+	writeConfigFile("Tool2.yml", "path: tool2", t)
+	writeConfigFile("Sub.yml", "path: sub", t)
+	writeConfigFile("sub/Tool3.yml", "path: tool3", t)
+	defer removeConfigFiles(t)
+
+	var test struct {
+		Sub   subBoxTool
+		Tool1 fsTool
+		Tool2 Tool
+	}
+	if err := LoadToolBox(&test, configPath); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "tool3", test.Sub.Sub.Tool3.Config.Path)
+	assert.Equal(t, "tool2", test.Tool1.Config.Path)
+}
+
+func TestBoxRefsCycle(t *testing.T) {
+	writeFiles("Tool1.yml", []byte(`path: '{{ ref "Sub.Tool2.Path" }}'`), t)
+	writeFiles("Tool2.yml", []byte(`path: '{{ ref "Tool1.Path" }}'`), t)
+	writeFiles("Tools.yml", []byte(`test1: {path: test1}`), t)
+	defer removeConfigFiles(t)
+
+	var test BoxRefs
+	err := LoadToolBox(&test, configPath)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "reference cycle: Sub.Tool2 -> Tool1 -> Sub.Tool2")
+	}
+}
+
+type BoxConfigDir struct {
+	Tool1 Tool `sprbox:"dir=Tool1.d"`
+}
+
+func TestBoxConfigDir(t *testing.T) {
+	BUILDENV = Development.ID()
+
+	writeConfigFile("Tool1.d/00-base.yml", "path: base", t)
+	writeConfigFile("Tool1.d/10-path.development.yml", "path: development", t)
+	defer removeConfigFiles(t)
+
+	var test BoxConfigDir
+	if err := LoadToolBox(&test, configPath); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "development", test.Tool1.Config.Path)
+}
+
+type BoxGlob struct {
+	Tool1 Tool            `sprbox:"Tool1/*.yml"`
+	Tools map[string]Tool `sprbox:"tenants/**/Tools"`
+}
+
+func TestBoxGlob(t *testing.T) {
+	BUILDENV = Development.ID()
+
+	writeConfigFile("Tool1/00-base.yml", "path: base", t)
+	writeConfigFile("Tool1/10-path.development.yml", "path: development", t)
+	writeConfigFile("tenants/a/Tools.yml", "a: {path: a}", t)
+	writeConfigFile("tenants/b/Tools.json", `{"b": {"path": "b"}}`, t)
+	defer removeConfigFiles(t)
+
+	var test BoxGlob
+	if err := LoadToolBox(&test, configPath); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "development", test.Tool1.Config.Path)
+	assert.Equal(t, "a", test.Tools["a"].Config.Path)
+	assert.Equal(t, "b", test.Tools["b"].Config.Path)
+}